@@ -91,7 +91,7 @@ func initEnv() error {
 		return fmt.Errorf("failed to bind env.load.dir flag: %w\n", err)
 	}
 
-	envLoadCmd.PersistentFlags().StringP("filename", "f", conf.DefaultEnvLoadFilename, "Config filename.")
+	envLoadCmd.PersistentFlags().StringP("filename", "f", "", fmt.Sprintf("Config filename (default %s).", strings.Join(conf.DefaultEnvLoadFilenames, ", ")))
 	if err := viper.BindPFlag("env.load.filename", envLoadCmd.PersistentFlags().Lookup("filename")); err != nil {
 		return fmt.Errorf("failed to bind env.load.filename flag: %w\n", err)
 	}
@@ -101,6 +101,81 @@ func initEnv() error {
 		return fmt.Errorf("failed to bind env.load.noLogDuration flag: %w\n", err)
 	}
 
+	envLoadCmd.PersistentFlags().Bool("stopAtGitRoot", false, "Stop looking for env files at the git root.")
+	if err := viper.BindPFlag("env.load.stopAtGitRoot", envLoadCmd.PersistentFlags().Lookup("stopAtGitRoot")); err != nil {
+		return fmt.Errorf("failed to bind env.load.stopAtGitRoot flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Bool("stopAtHome", false, "Stop looking for env files at the home directory.")
+	if err := viper.BindPFlag("env.load.stopAtHome", envLoadCmd.PersistentFlags().Lookup("stopAtHome")); err != nil {
+		return fmt.Errorf("failed to bind env.load.stopAtHome flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().StringSlice("ceilingDirs", nil, fmt.Sprintf("Directories above which env files are not looked up, added to $%s.", conf.EnvCeilingDirsVar))
+	if err := viper.BindPFlag("env.load.ceilingDirs", envLoadCmd.PersistentFlags().Lookup("ceilingDirs")); err != nil {
+		return fmt.Errorf("failed to bind env.load.ceilingDirs flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Bool("noGlobal", false, "Do not apply the user-global env files.")
+	if err := viper.BindPFlag("env.load.noGlobal", envLoadCmd.PersistentFlags().Lookup("noGlobal")); err != nil {
+		return fmt.Errorf("failed to bind env.load.noGlobal flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Bool("resolveSymlinks", false, "Resolve symlinks to detect duplicate path list elements.")
+	if err := viper.BindPFlag("env.load.resolveSymlinks", envLoadCmd.PersistentFlags().Lookup("resolveSymlinks")); err != nil {
+		return fmt.Errorf("failed to bind env.load.resolveSymlinks flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Bool("prune", false, "Drop path list elements that do not exist.")
+	if err := viper.BindPFlag("env.load.prune", envLoadCmd.PersistentFlags().Lookup("prune")); err != nil {
+		return fmt.Errorf("failed to bind env.load.prune flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Bool("noNotices", false, "Do not show notices of env files.")
+	if err := viper.BindPFlag("env.load.noNotices", envLoadCmd.PersistentFlags().Lookup("noNotices")); err != nil {
+		return fmt.Errorf("failed to bind env.load.noNotices flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("hookTimeout", "", "How long enter and leave hooks may run.")
+	if err := viper.BindPFlag("env.load.hookTimeout", envLoadCmd.PersistentFlags().Lookup("hookTimeout")); err != nil {
+		return fmt.Errorf("failed to bind env.load.hookTimeout flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("sandbox", "", "Which env files are restricted, without hooks and shell definitions: untrusted, all or off.")
+	if err := viper.BindPFlag("env.load.sandbox", envLoadCmd.PersistentFlags().Lookup("sandbox")); err != nil {
+		return fmt.Errorf("failed to bind env.load.sandbox flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().StringSlice("trustedDirs", nil, "Directories whose env files are trusted.")
+	if err := viper.BindPFlag("env.load.trustedDirs", envLoadCmd.PersistentFlags().Lookup("trustedDirs")); err != nil {
+		return fmt.Errorf("failed to bind env.load.trustedDirs flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("templateTimeout", "", "How long a template may run.")
+	if err := viper.BindPFlag("env.load.templateTimeout", envLoadCmd.PersistentFlags().Lookup("templateTimeout")); err != nil {
+		return fmt.Errorf("failed to bind env.load.templateTimeout flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().Int("templateMaxOutput", 0, "How many bytes a template may output.")
+	if err := viper.BindPFlag("env.load.templateMaxOutput", envLoadCmd.PersistentFlags().Lookup("templateMaxOutput")); err != nil {
+		return fmt.Errorf("failed to bind env.load.templateMaxOutput flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("reverseStore", "", "Where the reversal state is stored: env or file.")
+	if err := viper.BindPFlag("env.load.reverseStore", envLoadCmd.PersistentFlags().Lookup("reverseStore")); err != nil {
+		return fmt.Errorf("failed to bind env.load.reverseStore flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("drift", "", "What is done with keys changed since they were loaded: reconcile, preserve or reverse.")
+	if err := viper.BindPFlag("env.load.drift", envLoadCmd.PersistentFlags().Lookup("drift")); err != nil {
+		return fmt.Errorf("failed to bind env.load.drift flag: %w\n", err)
+	}
+
+	envLoadCmd.PersistentFlags().String("shell", "", "The shell that applies the env, enabling aliases and functions.")
+	if err := viper.BindPFlag("env.load.shell", envLoadCmd.PersistentFlags().Lookup("shell")); err != nil {
+		return fmt.Errorf("failed to bind env.load.shell flag: %w\n", err)
+	}
+
 	envCmd.AddCommand(envLoadCmd)
 	mainCmd.AddCommand(envCmd)
 
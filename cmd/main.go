@@ -51,6 +51,7 @@ func init() {
 	for _, initFunc := range []func() error{
 		initMain,
 		initEnv,
+		initSecrets,
 		initServices,
 	} {
 		if err := initFunc(); err != nil {
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.katupy.io/xpdt/conf"
+	"go.katupy.io/xpdt/env"
+)
+
+var secretsCmd = &cobra.Command{
+	Use:          "secrets",
+	Short:        "Manage encrypted files and values.",
+	SilenceUsage: true,
+}
+
+var secretsKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate the key of encrypted files and values.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		crypter, err := newCrypter()
+		if err != nil {
+			return err
+		}
+
+		keyFile, err := crypter.GenerateKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+
+		fmt.Println(keyFile)
+
+		return nil
+	},
+}
+
+var secretsEncryptCmd = &cobra.Command{
+	Use:   "encrypt [file]",
+	Short: "Encrypt a file to file.enc, or a value read from stdin.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		crypter, err := newCrypter()
+		if err != nil {
+			return err
+		}
+
+		if viper.GetBool("secrets.encrypt.value") {
+			value, err := readValue(args)
+			if err != nil {
+				return err
+			}
+
+			encrypted, err := crypter.EncryptValue(value)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt value: %w", err)
+			}
+
+			fmt.Println(encrypted)
+
+			return nil
+		}
+
+		if len(args) != 1 {
+			return errors.New("must provide exactly one file")
+		}
+
+		encryptedFilename, err := crypter.EncryptFile(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to encrypt file: %w", err)
+		}
+
+		fmt.Println(encryptedFilename)
+
+		return nil
+	},
+}
+
+var secretsDecryptCmd = &cobra.Command{
+	Use:   "decrypt [file]",
+	Short: "Print the plaintext of an encrypted file, or of a value read from stdin.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		crypter, err := newCrypter()
+		if err != nil {
+			return err
+		}
+
+		if viper.GetBool("secrets.decrypt.value") {
+			value, err := readValue(args)
+			if err != nil {
+				return err
+			}
+
+			plaintext, err := crypter.DecryptValue(value)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt value: %w", err)
+			}
+
+			fmt.Println(plaintext)
+
+			return nil
+		}
+
+		if len(args) != 1 {
+			return errors.New("must provide exactly one file")
+		}
+
+		if err := crypter.DecryptFile(args[0], os.Stdout); err != nil {
+			return fmt.Errorf("failed to decrypt file: %w", err)
+		}
+
+		return nil
+	},
+}
+
+var secretsEditCmd = &cobra.Command{
+	Use:   "edit file",
+	Short: "Edit an encrypted file with $VISUAL or $EDITOR, creating it if necessary.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("must provide exactly one file")
+		}
+
+		crypter, err := newCrypter()
+		if err != nil {
+			return err
+		}
+
+		editor := os.Getenv("VISUAL")
+
+		if editor == "" {
+			editor = os.Getenv("EDITOR")
+		}
+
+		if editor == "" {
+			editor = "vi"
+		}
+
+		if err := crypter.EditFile(args[0], editor); err != nil {
+			return fmt.Errorf("failed to edit file: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func newCrypter() (*env.Crypter, error) {
+	if err := parseFlags(); err != nil {
+		return nil, fmt.Errorf("failed to parse flags: %w", err)
+	}
+
+	config, err := conf.Find()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find config: %w", err)
+	}
+
+	return env.NewCrypter(config), nil
+}
+
+// readValue reads a value from stdin, so it is not kept in the shell history.
+func readValue(args []string) (string, error) {
+	if len(args) > 0 {
+		return "", errors.New("values are read from stdin, not from arguments")
+	}
+
+	b, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read value: %w", err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func initSecrets() error {
+	secretsCmd.PersistentFlags().String("keyFile", "", fmt.Sprintf("The key file, unless $%s is set.", conf.EnvKeyVar))
+	if err := viper.BindPFlag("secrets.keyFile", secretsCmd.PersistentFlags().Lookup("keyFile")); err != nil {
+		return fmt.Errorf("failed to bind secrets.keyFile flag: %w\n", err)
+	}
+
+	secretsEncryptCmd.PersistentFlags().Bool("value", false, "Encrypt a value read from stdin.")
+	if err := viper.BindPFlag("secrets.encrypt.value", secretsEncryptCmd.PersistentFlags().Lookup("value")); err != nil {
+		return fmt.Errorf("failed to bind secrets.encrypt.value flag: %w\n", err)
+	}
+
+	secretsDecryptCmd.PersistentFlags().Bool("value", false, "Decrypt a value read from stdin.")
+	if err := viper.BindPFlag("secrets.decrypt.value", secretsDecryptCmd.PersistentFlags().Lookup("value")); err != nil {
+		return fmt.Errorf("failed to bind secrets.decrypt.value flag: %w\n", err)
+	}
+
+	secretsCmd.AddCommand(secretsKeygenCmd)
+	secretsCmd.AddCommand(secretsEncryptCmd)
+	secretsCmd.AddCommand(secretsDecryptCmd)
+	secretsCmd.AddCommand(secretsEditCmd)
+	mainCmd.AddCommand(secretsCmd)
+
+	return nil
+}
@@ -15,14 +15,25 @@ import (
 )
 
 const DefaultEnvLoadDir = "."
-const DefaultEnvLoadFilename = ".xpdt.toml"
+
+// DefaultEnvLoadFilenames are the env filenames looked up in each directory,
+// by precedence. Only one of them may exist in a directory.
+var DefaultEnvLoadFilenames = []string{".xpdt.toml", ".xpdt.yaml", ".xpdt.yml", ".xpdt.json"}
+
+// DefaultEnvGlobalFilenames are the filenames of the user-global env file,
+// looked up in the xpdt directory of the user config directory.
+var DefaultEnvGlobalFilenames = []string{"env.toml", "env.yaml", "env.yml", "env.json"}
 
 const EnvPrefix = "XPDT"
 const EnvConfigPath = EnvPrefix + "_CONFIG_PATH"
 const EnvReverseVar = EnvPrefix + "_REVERSE"
+const EnvChainVar = EnvPrefix + "_CHAIN"
+const EnvCeilingDirsVar = EnvPrefix + "_CEILING_DIRS"
+const EnvKeyVar = EnvPrefix + "_KEY"
 
 type Config struct {
-	Env *Env `toml:"env,omitempty" yaml:"env,omitempty"`
+	Env     *Env     `toml:"env,omitempty" yaml:"env,omitempty"`
+	Secrets *Secrets `toml:"secrets,omitempty" yaml:"secrets,omitempty"`
 
 	LogLevel   string `toml:"logLevel,omitempty" yaml:"logLevel,omitempty"`
 	NoLogColor bool   `toml:"noLogColor,omitempty" yaml:"noLogColor,omitempty"`
@@ -46,17 +57,113 @@ type EnvLoad struct {
 	Filename      string `toml:"filename,omitempty" yaml:"filename,omitempty"`
 	NoLogDuration bool   `toml:"noLogDuration,omitempty" yaml:"noLogDuration,omitempty"`
 
+	// Where env file discovery stops. The git root and the home directory
+	// are the last directories looked up, while ceiling dirs are not looked up.
+	StopAtGitRoot bool     `toml:"stopAtGitRoot,omitempty" yaml:"stopAtGitRoot,omitempty"`
+	StopAtHome    bool     `toml:"stopAtHome,omitempty" yaml:"stopAtHome,omitempty"`
+	CeilingDirs   []string `toml:"ceilingDirs,omitempty" yaml:"ceilingDirs,omitempty"`
+
+	// Whether the user-global env files are not applied.
+	NoGlobal bool `toml:"noGlobal,omitempty" yaml:"noGlobal,omitempty"`
+
+	// Whether symlinks are resolved to detect duplicate path list elements.
+	ResolveSymlinks bool `toml:"resolveSymlinks,omitempty" yaml:"resolveSymlinks,omitempty"`
+
+	// Whether path list elements that do not exist are dropped.
+	Prune bool `toml:"prune,omitempty" yaml:"prune,omitempty"`
+
+	// Whether notices of env files are hidden.
+	NoNotices bool `toml:"noNotices,omitempty" yaml:"noNotices,omitempty"`
+
+	// How long enter and leave hooks may run, e.g. "5s".
+	HookTimeout string `toml:"hookTimeout,omitempty" yaml:"hookTimeout,omitempty"`
+
+	// Which env files are restricted: "untrusted" (default), "all" or "off".
+	// Restricted files have their templates restricted, their hooks and
+	// shell definitions skipped, and cannot use secrets, encrypted values or
+	// encrypted data files. Overwrite and global files, and files under
+	// trusted dirs, which may start with ~, are trusted.
+	Sandbox     string   `toml:"sandbox,omitempty" yaml:"sandbox,omitempty"`
+	TrustedDirs []string `toml:"trustedDirs,omitempty" yaml:"trustedDirs,omitempty"`
+
+	// How long a template may run, e.g. "2s", and how many bytes it may output.
+	TemplateTimeout   string `toml:"templateTimeout,omitempty" yaml:"templateTimeout,omitempty"`
+	TemplateMaxOutput int    `toml:"templateMaxOutput,omitempty" yaml:"templateMaxOutput,omitempty"`
+
+	// Where the reversal state is stored: "env" (default), in $XPDT_REVERSE,
+	// or "file", in a private file under $XDG_RUNTIME_DIR referenced by it,
+	// which must be set. Reverse files are removed after a day unused.
+	ReverseStore string `toml:"reverseStore,omitempty" yaml:"reverseStore,omitempty"`
+
+	// What is done, when the env is reversed, with keys changed since
+	// they were loaded: "reconcile" (default) keeps the changes, only removing
+	// the elements xpdt added to path lists, "preserve" keeps the changed values,
+	// and "reverse" overwrites them. Kept values are not reversed again, so the
+	// values the keys had before xpdt are lost. Changes to secrets are only
+	// detected with $XDG_RUNTIME_DIR set, and are overwritten otherwise.
+	Drift string `toml:"drift,omitempty" yaml:"drift,omitempty"`
+
+	// The shell that applies the diff. Shell aliases
+	// and functions are only written if it is set.
+	Shell string `toml:"shell,omitempty" yaml:"shell,omitempty"`
+
 	// The original environment, before loading changes.
 	Environ []string `toml:"environ,omitempty" yaml:"environ,omitempty"`
 }
 
 type EnvOverwrite struct {
-	Dir  string `toml:"dir,omitempty" yaml:"dir,omitempty"`
+	// The directory the overwrite applies to, which may start with ~
+	// and contain glob patterns, e.g. ~/src/*/service-*.
+	// If Remote is set, it is relative to the git root and defaults to it.
+	Dir string `toml:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// The git remote URL of the repository the overwrite applies to,
+	// which may contain glob patterns, e.g. github.com/katupy/*.
+	// The scheme, user and .git suffix are ignored.
+	Remote string `toml:"remote,omitempty" yaml:"remote,omitempty"`
+
+	// Where the overwrite applies, by hostname, username and
+	// platform (e.g. linux_amd64), which may contain glob patterns.
+	// The overwrite applies if each non-empty filter has a match.
+	Hosts     []string `toml:"hosts,omitempty" yaml:"hosts,omitempty"`
+	Users     []string `toml:"users,omitempty" yaml:"users,omitempty"`
+	Platforms []string `toml:"platforms,omitempty" yaml:"platforms,omitempty"`
+
 	File string `toml:"file,omitempty" yaml:"file,omitempty"`
 	Root bool   `toml:"root,omitempty" yaml:"root,omitempty"`
 	Skip bool   `toml:"skip,omitempty" yaml:"skip,omitempty"`
 }
 
+type Secrets struct {
+	Providers []*SecretProvider `toml:"providers,omitempty" yaml:"providers,omitempty"`
+
+	// Where resolved secrets are cached: "memory" (default), which only
+	// lasts for a single load, so every load runs the providers again,
+	// or "file", encrypted in the user cache dir with a key kept in
+	// $XDG_RUNTIME_DIR, which must be set.
+	Cache string `toml:"cache,omitempty" yaml:"cache,omitempty"`
+
+	// How long the file cache keeps a secret across loads, e.g. "5m".
+	// It has no effect on the memory cache.
+	CacheTTL string `toml:"cacheTTL,omitempty" yaml:"cacheTTL,omitempty"`
+
+	// The file with the base64 key of encrypted files and values,
+	// which defaults to the key file of the user config dir.
+	// $XPDT_KEY takes precedence.
+	KeyFile string `toml:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+}
+
+// SecretProvider is an executable that prints the secret of a key,
+// which is passed as its last argument, e.g. pass show <key>.
+type SecretProvider struct {
+	Name    string   `toml:"name,omitempty" yaml:"name,omitempty"`
+	Command string   `toml:"command,omitempty" yaml:"command,omitempty"`
+	Args    []string `toml:"args,omitempty" yaml:"args,omitempty"`
+
+	// How long the provider may run, e.g. "10s".
+	Timeout string `toml:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
 type Service struct {
 	Name string `toml:"name,omitempty" yaml:"name,omitempty"`
 
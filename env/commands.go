@@ -1,12 +1,19 @@
 package env
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
 
+	"github.com/rs/zerolog/log"
 	"go.katupy.io/klib"
 )
 
+// defaultSeparator is the separator of tokens in plain string keys.
+const defaultSeparator = " "
+
 type CommandLoader interface {
 	Load(cmd *Command) error
 }
@@ -30,6 +37,14 @@ func (l *defaultCommandLoader) Load(cmd *Command) error {
 		cmdFunc = l.commandMethods.Set
 	case cmd.Del != "":
 		cmdFunc = l.commandMethods.Del
+	case cmd.Default != "":
+		cmdFunc = l.commandMethods.Default
+	case cmd.Extend != "":
+		cmdFunc = l.commandMethods.Extend
+	case cmd.Require != "":
+		cmdFunc = l.commandMethods.Require
+	case cmd.Echo != "":
+		cmdFunc = l.commandMethods.Echo
 	}
 
 	if err := cmdFunc(cmd); err != nil {
@@ -43,6 +58,10 @@ type CommandMethods interface {
 	Add(cmd *Command) error
 	Set(cmd *Command) error
 	Del(cmd *Command) error
+	Default(cmd *Command) error
+	Extend(cmd *Command) error
+	Require(cmd *Command) error
+	Echo(cmd *Command) error
 }
 
 type defaultCommandMethods struct {
@@ -51,19 +70,36 @@ type defaultCommandMethods struct {
 	pathHandler     PathHandler
 	pathLoader      PathLoader
 	templateHandler klib.StringHandler
+	secretResolver  SecretResolver
+	keys            *keySource
+
+	// Notices rendered by echo commands.
+	notices []*notice
 }
 
 func (m *defaultCommandMethods) Add(cmd *Command) error {
+	// Validate positions before existing elements are moved.
+	if err := checkPathPosition(cmd); err != nil {
+		return klib.ForwardError("112b4137-19bf-4c93-8e52-cd88f9c456f7", err)
+	}
+
 	var values []string
 
 	switch {
 	case cmd.Value != "":
+		if err := checkNotEncrypted(cmd, cmd.Value, ".value"); err != nil {
+			return klib.ForwardError("e7316557-43fa-459a-84ab-de243e95052a", err)
+		}
+
 		value, err := m.templateHandler.Handle(cmd.Value)
 		if err != nil {
 			return klib.ForwardError("8f6fe0e7-9037-4b26-94a5-83633ea0c142", err)
 		}
 
-		values = []string{value}
+		values, err = expandPath(value, cmd.SkipMissing)
+		if err != nil {
+			return klib.ForwardError("90e54b17-3738-43a2-9f03-d5116c4ac693", err)
+		}
 	default:
 		return &klib.Error{
 			ID:     "ce66adb8-2e56-40b7-8268-27a8955296b5",
@@ -75,75 +111,271 @@ func (m *defaultCommandMethods) Add(cmd *Command) error {
 	}
 
 	key := cmd.Add
-	keyName := key
 
-	if m.container.caseInsensitiveEnvironment {
-		keyName = strings.ToUpper(keyName)
-	}
+	if len(values) == 0 {
+		// A glob without matches or a missing path that should be skipped.
+		log.Debug().
+			Str("_label", "pathValueSkipped").
+			Str("key", key).
+			Str("value", cmd.Value).
+			Send()
 
-	envVar, haveVar := m.container.env[keyName]
-	if !haveVar {
-		envVar = &environVar{
-			key:     key,
-			created: true,
-		}
-		m.container.env[keyName] = envVar
+		return nil
 	}
 
-	// Ensure key persists if it was deleted before.
-	if envVar.delete {
-		envVar.delete = false
-	}
+	envVar := m.container.envVar(key)
 
 	if err := m.pathLoader.Load(envVar); err != nil {
 		return klib.ForwardError("bfb999a7-55af-47ab-a8b3-bc15be757c48", err)
 	}
 
+	// Existing elements are moved to the requested position.
 	for i := range values {
-		var index int
-
-		if cmd.Append {
-			index -= 1
+		if err := m.pathHandler.Remove(envVar, values[i]); err != nil {
+			return klib.ForwardError("06204839-72d5-4a66-99a1-35d74ccaca7d", err)
 		}
+	}
 
-		if err := m.pathHandler.Add(envVar, values[i], index); err != nil {
+	index, err := m.pathIndex(cmd, envVar)
+	if err != nil {
+		return klib.ForwardError("a31d130a-e938-41fb-935a-9a4f18e10851", err)
+	}
+
+	for i := range values {
+		added, err := m.pathHandler.Add(envVar, values[i], index)
+		if err != nil {
 			return klib.ForwardError("4aa49cf3-1289-403a-bbb2-b25d6ad84a4c", err)
 		}
+
+		// Keep the order of values when inserting at a fixed index,
+		// skipping values that resolve to an element already added.
+		if added && index >= 0 {
+			index++
+		}
+	}
+
+	return nil
+}
+
+// checkPathPosition returns an error if more than one
+// of before, after or position is set in cmd.
+func checkPathPosition(cmd *Command) error {
+	var positions int
+
+	for _, set := range []bool{cmd.Before != "", cmd.After != "", cmd.Position != nil} {
+		if set {
+			positions++
+		}
+	}
+
+	if positions > 1 {
+		return &klib.Error{
+			ID:     "52e8fa5b-29d7-4007-b0a8-ee2eb1b2ad0e",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Detail: fmt.Sprintf("Only one of before, after or position can be set for key %s.", cmd.Add),
+			Meta: map[string]any{
+				"key":      cmd.Add,
+				"before":   cmd.Before,
+				"after":    cmd.After,
+				"position": cmd.Position,
+			},
+		}
 	}
 
 	return nil
 }
 
+// checkNotEncrypted fails if the field of cmd is an encrypted value,
+// which is only decrypted by set and default commands.
+func checkNotEncrypted(cmd *Command, value, field string) error {
+	if !isEncrypted(value) {
+		return nil
+	}
+
+	return &klib.Error{
+		ID:     "8d6164ed-78ca-46a9-a361-ace3ba20611a",
+		Status: http.StatusBadRequest,
+		Code:   klib.CodeInvalidValue,
+		Path:   cmd.path() + field,
+		Detail: fmt.Sprintf("Encrypted values are only allowed in set and default commands, not in %s of %s.", cmd.path(), cmd.filePath()),
+		Meta: map[string]any{
+			"filepath": cmd.filePath(),
+		},
+	}
+}
+
+// pathIndex returns the index in the path list of envVar
+// where the values of cmd should be inserted.
+func (m *defaultCommandMethods) pathIndex(cmd *Command, envVar *environVar) (int, error) {
+	length := len(envVar.pathListElements)
+
+	switch {
+	case cmd.Position != nil:
+		index := *cmd.Position
+
+		if index < 0 {
+			index += length + 1
+		}
+
+		if index < 0 {
+			return 0, nil
+		}
+
+		if index > length {
+			return length, nil
+		}
+
+		return index, nil
+	case cmd.Before != "" || cmd.After != "":
+		anchor := cmd.Before
+
+		if anchor == "" {
+			anchor = cmd.After
+		}
+
+		anchor, err := m.templateHandler.Handle(anchor)
+		if err != nil {
+			return 0, klib.ForwardError("f379812c-8753-45ba-872d-15b3616ede5b", err)
+		}
+
+		anchor, err = expandTilde(strings.TrimSpace(anchor))
+		if err != nil {
+			return 0, klib.ForwardError("f59e3b65-0a20-466a-9f75-54efd5bf57bf", err)
+		}
+
+		index, err := m.pathHandler.Index(envVar, anchor)
+		if err != nil {
+			return 0, klib.ForwardError("e5af32a1-a27b-4085-935a-cf487009b1ee", err)
+		}
+
+		if index >= 0 {
+			if cmd.After != "" {
+				index++
+			}
+
+			return index, nil
+		}
+
+		// Fall back to prepending or appending when the anchor is missing.
+		log.Debug().
+			Str("_label", "pathAnchorNotFound").
+			Str("key", envVar.key).
+			Str("anchor", anchor).
+			Bool("append", cmd.Append).
+			Send()
+	}
+
+	if cmd.Append {
+		return -1, nil
+	}
+
+	return 0, nil
+}
+
 func (m *defaultCommandMethods) Set(cmd *Command) error {
-	value, err := m.templateHandler.Handle(cmd.Value)
+	value, secret, err := m.value(cmd)
 	if err != nil {
 		return klib.ForwardError("03ba5588-7ed1-43c9-b78e-36817c63b4e0", err)
 	}
 
-	key := cmd.Set
-	keyName := key
+	envVar := m.container.envVar(cmd.Set)
+	envVar.currentValue = value
+	envVar.secret = secret
 
-	if m.container.caseInsensitiveEnvironment {
-		keyName = strings.ToUpper(keyName)
+	return nil
+}
+
+// value returns the value of a set or default command, which is either
+// a template, an encrypted value or a secret, and whether it is secret.
+func (m *defaultCommandMethods) value(cmd *Command) (string, bool, error) {
+	if cmd.Secret == "" {
+		if isEncrypted(cmd.Value) {
+			// Untrusted files could decrypt any value copied from a trusted file.
+			if cmd.file != nil && !cmd.file.trusted {
+				return "", false, &klib.Error{
+					ID:     "1a352d46-0aeb-476c-8bcf-0ff950bfeb9f",
+					Status: http.StatusForbidden,
+					Code:   klib.CodeInvalidValue,
+					Path:   cmd.path() + ".value",
+					Detail: fmt.Sprintf("Encrypted values are not allowed in untrusted files, trust the dir of %s to allow them.", cmd.filePath()),
+					Meta: map[string]any{
+						"filepath": cmd.filePath(),
+					},
+				}
+			}
+
+			if m.keys == nil {
+				m.keys = newKeySource(nil)
+			}
+
+			key, err := m.keys.get()
+			if err != nil {
+				return "", false, klib.ForwardError("cec47146-83ae-4fb3-843f-dea5011a8e61", err)
+			}
+
+			value, err := decrypt(key, cmd.Value, fmt.Sprintf("the value of %s in %s", cmd.path(), cmd.filePath()))
+			if err != nil {
+				return "", false, klib.ForwardError("3aabf2a3-ee4a-4315-92e4-10f62b6d6288", err)
+			}
+
+			return string(value), true, nil
+		}
+
+		value, err := m.templateHandler.Handle(cmd.Value)
+		if err != nil {
+			return "", false, klib.ForwardError("2f5ecdbb-bcdd-4664-bb2f-3d7caf5e389d", err)
+		}
+
+		return value, false, nil
 	}
 
-	envVar, haveVar := m.container.env[keyName]
-	if !haveVar {
-		envVar = &environVar{
-			key:     key,
-			created: true,
+	if cmd.Value != "" {
+		return "", false, &klib.Error{
+			ID:     "d200aeca-6e00-4bc0-a934-466fc5a0d28a",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   cmd.path(),
+			Detail: "Only one of value or secret can be set.",
+			Meta: map[string]any{
+				"filepath": cmd.filePath(),
+			},
 		}
-		m.container.env[keyName] = envVar
 	}
 
-	envVar.currentValue = value
+	// Untrusted files could read any secret of the user.
+	if cmd.file != nil && !cmd.file.trusted {
+		return "", false, &klib.Error{
+			ID:     "b9dee5ff-bdaa-411c-8c80-7305a44d0033",
+			Status: http.StatusForbidden,
+			Code:   klib.CodeInvalidValue,
+			Path:   cmd.path() + ".secret",
+			Detail: fmt.Sprintf("Secrets are not allowed in untrusted files, trust the dir of %s to allow them.", cmd.filePath()),
+			Meta: map[string]any{
+				"filepath": cmd.filePath(),
+			},
+		}
+	}
 
-	// Ensure key persists if it was deleted before.
-	if envVar.delete {
-		envVar.delete = false
+	if m.secretResolver == nil {
+		return "", false, &klib.Error{
+			ID:     "844fb0f9-10e0-4902-8ac0-41ac5ba4f4bd",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+			Path:   cmd.path() + ".secret",
+			Detail: "There are no secret providers configured.",
+			Meta: map[string]any{
+				"filepath": cmd.filePath(),
+			},
+		}
 	}
 
-	return nil
+	value, err := m.secretResolver.Resolve(cmd.Provider, cmd.Secret, m.container.environ())
+	if err != nil {
+		return "", false, klib.ForwardError("3be7074a-918e-4164-b413-e56994928719", err)
+	}
+
+	return value, true, nil
 }
 
 func (m *defaultCommandMethods) Del(cmd *Command) error {
@@ -164,3 +396,294 @@ func (m *defaultCommandMethods) Del(cmd *Command) error {
 
 	return nil
 }
+
+// Default sets the value of a key only if it is unset or empty.
+func (m *defaultCommandMethods) Default(cmd *Command) error {
+	key := cmd.Default
+	keyName := key
+
+	if m.container.caseInsensitiveEnvironment {
+		keyName = strings.ToUpper(keyName)
+	}
+
+	if envVar, haveVar := m.container.env[keyName]; haveVar && !envVar.delete && envVar.currentValue != "" {
+		return nil
+	}
+
+	value, secret, err := m.value(cmd)
+	if err != nil {
+		return klib.ForwardError("d91c04c6-01cc-47ca-94db-d13684994f76", err)
+	}
+
+	envVar := m.container.envVar(key)
+	envVar.currentValue = value
+	envVar.secret = secret
+
+	return nil
+}
+
+// Extend prepends or appends the tokens of a value to a plain string key,
+// unless the key already has them in sequence. Single tokens are never
+// skipped, since flags such as -I may be repeated with other arguments.
+func (m *defaultCommandMethods) Extend(cmd *Command) error {
+	if err := checkNotEncrypted(cmd, cmd.Value, ".value"); err != nil {
+		return klib.ForwardError("4694c814-50a8-455b-a399-78ad10eeacb4", err)
+	}
+
+	value, err := m.templateHandler.Handle(cmd.Value)
+	if err != nil {
+		return klib.ForwardError("e93a7021-f896-4cea-a81b-e0f5d4373d04", err)
+	}
+
+	key := cmd.Extend
+	envVar := m.container.envVar(key)
+
+	if envVar.pathList {
+		return &klib.Error{
+			ID:     "5d8bc519-6048-4192-a37f-3cff31ffc0f7",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Detail: fmt.Sprintf("Key %s is a path list, use add instead.", key),
+			Meta: map[string]any{
+				"key": key,
+			},
+		}
+	}
+
+	separator := cmd.Separator
+
+	if separator == "" {
+		separator = defaultSeparator
+	}
+
+	tokens := splitTokens(envVar.currentValue, separator)
+	newTokens := splitTokens(value, separator)
+
+	if containsTokens(tokens, newTokens) {
+		return nil
+	}
+
+	if cmd.Append {
+		tokens = append(tokens, newTokens...)
+	} else {
+		tokens = append(newTokens, tokens...)
+	}
+
+	envVar.currentValue = strings.Join(tokens, separator)
+
+	return nil
+}
+
+// Require validates that a key satisfies the checks of cmd.
+func (m *defaultCommandMethods) Require(cmd *Command) error {
+	key := cmd.Require
+	keyName := key
+
+	if m.container.caseInsensitiveEnvironment {
+		keyName = strings.ToUpper(keyName)
+	}
+
+	envVar, haveVar := m.container.env[keyName]
+	if haveVar && envVar.delete {
+		haveVar = false
+	}
+
+	var value, shownValue string
+
+	if haveVar {
+		value = envVar.currentValue
+
+		if envVar.pathList {
+			value = strings.Join(envVar.pathListElements, string(os.PathListSeparator))
+		}
+
+		shownValue = value
+
+		if envVar.secret {
+			shownValue = "<secret>"
+		}
+	}
+
+	fail := func(id, code, reason string) error {
+		detail := reason
+
+		if cmd.Message != "" {
+			message, err := m.templateHandler.Handle(cmd.Message)
+			if err != nil {
+				return klib.ForwardError("7b17752d-a6fa-4166-abcc-72aa2c872d28", err)
+			}
+
+			detail = message
+		}
+
+		if filePath := cmd.filePath(); filePath != "" {
+			detail = fmt.Sprintf("%s (%s, command %d)", detail, filePath, cmd.index)
+		}
+
+		return &klib.Error{
+			ID:     id,
+			Status: http.StatusBadRequest,
+			Code:   code,
+			Path:   cmd.path(),
+			Title:  "Requirement not met",
+			Detail: detail,
+			Meta: map[string]any{
+				"key":      key,
+				"filepath": cmd.filePath(),
+				"reason":   reason,
+			},
+		}
+	}
+
+	check := cmd.Check
+
+	if check == "" {
+		check = RequireCheckNonEmpty
+	}
+
+	switch check {
+	case RequireCheckSet:
+		if !haveVar {
+			return fail("8528c69f-7cb4-4054-87d7-396347771d42", klib.CodeMissingValue, fmt.Sprintf("Env var %s is not set.", key))
+		}
+	case RequireCheckNonEmpty:
+		if value == "" {
+			return fail("d8c5ad81-66ff-4bfc-a6f2-0a99d0418861", klib.CodeMissingValue, fmt.Sprintf("Env var %s is not set or empty.", key))
+		}
+	case RequireCheckFile, RequireCheckDir:
+		if value == "" {
+			return fail("7961fe7c-96d2-4b04-b5c8-05b02c60649d", klib.CodeMissingValue, fmt.Sprintf("Env var %s is not set or empty.", key))
+		}
+
+		filePath, err := expandTilde(value)
+		if err != nil {
+			return klib.ForwardError("881e0073-afe8-4595-a4bd-9c9893184009", err)
+		}
+
+		info, err := os.Stat(filePath)
+
+		switch {
+		case err != nil:
+			return fail("cc82f3b0-fc78-42c4-b0be-e549d9126a8e", klib.CodeNotFound, fmt.Sprintf("Env var %s points to %s, which does not exist.", key, shownValue))
+		case check == RequireCheckDir && !info.IsDir():
+			return fail("45c43a7f-5990-4faa-a46c-1f13b412c8c9", klib.CodeInvalidValue, fmt.Sprintf("Env var %s points to %s, which is not a directory.", key, shownValue))
+		case check == RequireCheckFile && info.IsDir():
+			return fail("72030b77-3230-4ec1-a8b3-854003b154eb", klib.CodeInvalidValue, fmt.Sprintf("Env var %s points to %s, which is not a file.", key, shownValue))
+		}
+	default:
+		return &klib.Error{
+			ID:     "592fbdb3-9913-458a-b987-69151703204a",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   cmd.path() + ".check",
+			Detail: fmt.Sprintf("Unsupported check %q.", check),
+			Meta: map[string]any{
+				"filepath": cmd.filePath(),
+			},
+		}
+	}
+
+	if cmd.Match != "" {
+		re, err := regexp.Compile(cmd.Match)
+		if err != nil {
+			return &klib.Error{
+				ID:     "196d64fc-a5c5-4f4f-bac8-d0e87c403933",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeParseError,
+				Path:   cmd.path() + ".match",
+				Title:  "Failed to compile regex",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"filepath": cmd.filePath(),
+				},
+			}
+		}
+
+		if !re.MatchString(value) {
+			return fail("710d54f3-8f1c-4815-a4c9-455a7f1d7500", klib.CodeInvalidValue, fmt.Sprintf("Env var %s does not match %s.", key, cmd.Match))
+		}
+	}
+
+	return nil
+}
+
+// Echo renders a notice to be shown after the environment is loaded.
+func (m *defaultCommandMethods) Echo(cmd *Command) error {
+	level := cmd.Level
+
+	if level == "" {
+		level = EchoLevelInfo
+	}
+
+	if level != EchoLevelInfo && level != EchoLevelWarn {
+		return &klib.Error{
+			ID:     "fe1db2a3-e9a9-47f8-b7d5-d88191fb9f3e",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   cmd.path() + ".level",
+			Detail: fmt.Sprintf("Unsupported level %q.", level),
+			Meta: map[string]any{
+				"filepath": cmd.filePath(),
+			},
+		}
+	}
+
+	if err := checkNotEncrypted(cmd, cmd.Echo, ".echo"); err != nil {
+		return klib.ForwardError("5df042a9-3650-4e5d-a015-4a3b871d2075", err)
+	}
+
+	message, err := m.templateHandler.Handle(cmd.Echo)
+	if err != nil {
+		return klib.ForwardError("81ccee08-607b-401b-86dc-0ed1be67070a", err)
+	}
+
+	m.notices = append(m.notices, &notice{
+		level:   level,
+		message: message,
+		file:    cmd.file,
+	})
+
+	return nil
+}
+
+// containsTokens returns whether tokens contain all of sub in sequence.
+func containsTokens(tokens, sub []string) bool {
+	if len(sub) == 0 {
+		return true
+	}
+
+	for i := 0; i+len(sub) <= len(tokens); i++ {
+		match := true
+
+		for j := range sub {
+			if tokens[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitTokens splits value by separator, ignoring empty tokens.
+// A whitespace separator splits on any amount of whitespace.
+func splitTokens(value, separator string) []string {
+	if strings.TrimSpace(separator) == "" {
+		return strings.Fields(value)
+	}
+
+	var tokens []string
+
+	for _, token := range strings.Split(value, separator) {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
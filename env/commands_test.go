@@ -1,15 +1,21 @@
 package env
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"go.katupy.io/klib"
 	"go.katupy.io/klib/mucache"
+
+	"go.katupy.io/xpdt/conf"
 )
 
 func Test_defaultCommandLoader_Load(t *testing.T) {
@@ -60,6 +66,46 @@ func Test_defaultCommandLoader_Load(t *testing.T) {
 				{"Del", &Command{Del: "yes"}, nil},
 			},
 		},
+		{
+			name: "method-default",
+			cmd: &Command{
+				Default: "yes",
+			},
+			commandLoader: &defaultCommandLoader{},
+			mockCommandMethodsOn: [][]any{
+				{"Default", &Command{Default: "yes"}, nil},
+			},
+		},
+		{
+			name: "method-extend",
+			cmd: &Command{
+				Extend: "yes",
+			},
+			commandLoader: &defaultCommandLoader{},
+			mockCommandMethodsOn: [][]any{
+				{"Extend", &Command{Extend: "yes"}, nil},
+			},
+		},
+		{
+			name: "method-require",
+			cmd: &Command{
+				Require: "yes",
+			},
+			commandLoader: &defaultCommandLoader{},
+			mockCommandMethodsOn: [][]any{
+				{"Require", &Command{Require: "yes"}, nil},
+			},
+		},
+		{
+			name: "method-echo",
+			cmd: &Command{
+				Echo: "yes",
+			},
+			commandLoader: &defaultCommandLoader{},
+			mockCommandMethodsOn: [][]any{
+				{"Echo", &Command{Echo: "yes"}, nil},
+			},
+		},
 	}
 
 	for i := range testCases {
@@ -85,6 +131,28 @@ func Test_defaultCommandLoader_Load(t *testing.T) {
 
 func Test_defaultCommandMethods_Add(t *testing.T) {
 	cache := mucache.New[string, *environVar]()
+	negativePosition := -2
+	zeroPosition := 0
+
+	toolsDir := t.TempDir()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(filepath.Join(toolsDir, name, "bin"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toolBin := func(name string) string {
+		return filepath.Join(toolsDir, name, "bin")
+	}
+
+	// Number of arguments of each PathHandler method,
+	// the remaining values of an expectation are returned.
+	pathHandlerArgs := map[string]int{
+		"Add":    3,
+		"Index":  2,
+		"Remove": 2,
+	}
 
 	testCases := []*struct {
 		name                  string
@@ -92,7 +160,7 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 		compareKey            string
 		commandMethods        *defaultCommandMethods
 		wantEnv               map[string]*environVar
-		mockTemplateHandlerOn []any
+		mockTemplateHandlerOn [][]any
 		mockPathLoaderOn      []any
 		mockPathHandlerOn     [][]any
 		err                   *klib.Error
@@ -107,6 +175,20 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 				Code:   klib.CodeMissingValue,
 			},
 		},
+		{
+			name: "encrypted-value",
+			cmd: &Command{
+				Add:   "PATH",
+				Value: EncryptedPrefix + "Zm9v",
+			},
+			commandMethods: &defaultCommandMethods{},
+			err: &klib.Error{
+				ID:     "8d6164ed-78ca-46a9-a361-ace3ba20611a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].value",
+			},
+		},
 		{
 			name: "append-and-undelete",
 			cmd: &Command{
@@ -134,10 +216,13 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 					},
 				),
 			},
-			mockTemplateHandlerOn: []any{"Handle", "=", "OK", nil},
-			mockPathLoaderOn:      []any{"Load", cache.Get("append-and-undelete"), nil},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "=", "OK", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("append-and-undelete"), nil},
 			mockPathHandlerOn: [][]any{
-				{"Add", cache.Get("append-and-undelete"), "OK", -1, nil},
+				{"Remove", cache.Get("append-and-undelete"), "OK", nil},
+				{"Add", cache.Get("append-and-undelete"), "OK", -1, true, nil},
 			},
 		},
 		{
@@ -161,10 +246,13 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 					},
 				),
 			},
-			mockTemplateHandlerOn: []any{"Handle", "@", "Done", nil},
-			mockPathLoaderOn:      []any{"Load", cache.Get("prepend"), nil},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("prepend"), nil},
 			mockPathHandlerOn: [][]any{
-				{"Add", cache.Get("prepend"), "Done", 0, nil},
+				{"Remove", cache.Get("prepend"), "Done", nil},
+				{"Add", cache.Get("prepend"), "Done", 0, true, nil},
 			},
 		},
 		{
@@ -189,10 +277,236 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 					},
 				),
 			},
-			mockTemplateHandlerOn: []any{"Handle", "@", "Done", nil},
-			mockPathLoaderOn:      []any{"Load", cache.Get("prepend-case-insensitive"), nil},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("prepend-case-insensitive"), nil},
+			mockPathHandlerOn: [][]any{
+				{"Remove", cache.Get("prepend-case-insensitive"), "Done", nil},
+				{"Add", cache.Get("prepend-case-insensitive"), "Done", 0, true, nil},
+			},
+		},
+		{
+			name: "before-anchor",
+			cmd: &Command{
+				Add:    "bar",
+				Value:  "@",
+				Before: "#",
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"bar": cache.SetGet(
+					"before-anchor",
+					&environVar{
+						key:     "bar",
+						created: true,
+					},
+				),
+			},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+				{"Handle", "#", "Anchor", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("before-anchor"), nil},
+			mockPathHandlerOn: [][]any{
+				{"Remove", cache.Get("before-anchor"), "Done", nil},
+				{"Index", cache.Get("before-anchor"), "Anchor", 1, nil},
+				{"Add", cache.Get("before-anchor"), "Done", 1, true, nil},
+			},
+		},
+		{
+			name: "after-anchor",
+			cmd: &Command{
+				Add:   "bar",
+				Value: "@",
+				After: "#",
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"bar": cache.SetGet(
+					"after-anchor",
+					&environVar{
+						key:     "bar",
+						created: true,
+					},
+				),
+			},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+				{"Handle", "#", "Anchor", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("after-anchor"), nil},
+			mockPathHandlerOn: [][]any{
+				{"Remove", cache.Get("after-anchor"), "Done", nil},
+				{"Index", cache.Get("after-anchor"), "Anchor", 1, nil},
+				{"Add", cache.Get("after-anchor"), "Done", 2, true, nil},
+			},
+		},
+		{
+			name: "missing-anchor-append",
+			cmd: &Command{
+				Add:    "bar",
+				Value:  "@",
+				Before: "#",
+				Append: true,
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"bar": cache.SetGet(
+					"missing-anchor-append",
+					&environVar{
+						key:     "bar",
+						created: true,
+					},
+				),
+			},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+				{"Handle", "#", "Anchor", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("missing-anchor-append"), nil},
+			mockPathHandlerOn: [][]any{
+				{"Remove", cache.Get("missing-anchor-append"), "Done", nil},
+				{"Index", cache.Get("missing-anchor-append"), "Anchor", -1, nil},
+				{"Add", cache.Get("missing-anchor-append"), "Done", -1, true, nil},
+			},
+		},
+		{
+			name: "negative-position",
+			cmd: &Command{
+				Add:      "bar",
+				Value:    "@",
+				Position: &negativePosition,
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"bar": {
+							key:              "bar",
+							pathListElements: []string{"a", "b"},
+						},
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"bar": cache.SetGet(
+					"negative-position",
+					&environVar{
+						key:              "bar",
+						pathListElements: []string{"a", "b"},
+					},
+				),
+			},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "@", "Done", nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("negative-position"), nil},
+			mockPathHandlerOn: [][]any{
+				{"Remove", cache.Get("negative-position"), "Done", nil},
+				{"Add", cache.Get("negative-position"), "Done", 1, true, nil},
+			},
+		},
+		{
+			// The second match resolves to an element added by the first one.
+			name: "position-duplicate-match",
+			cmd: &Command{
+				Add:      "bar",
+				Value:    "tools",
+				Position: &zeroPosition,
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"bar": {
+							key: "bar",
+						},
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"bar": cache.SetGet(
+					"position-duplicate-match",
+					&environVar{
+						key: "bar",
+					},
+				),
+			},
+			mockTemplateHandlerOn: [][]any{
+				{"Handle", "tools", filepath.Join(toolsDir, "*", "bin"), nil},
+			},
+			mockPathLoaderOn: []any{"Load", cache.Get("position-duplicate-match"), nil},
 			mockPathHandlerOn: [][]any{
-				{"Add", cache.Get("prepend-case-insensitive"), "Done", 0, nil},
+				{"Remove", cache.Get("position-duplicate-match"), toolBin("a"), nil},
+				{"Remove", cache.Get("position-duplicate-match"), toolBin("b"), nil},
+				{"Remove", cache.Get("position-duplicate-match"), toolBin("c"), nil},
+				{"Add", cache.Get("position-duplicate-match"), toolBin("a"), 0, true, nil},
+				{"Add", cache.Get("position-duplicate-match"), toolBin("b"), 1, false, nil},
+				{"Add", cache.Get("position-duplicate-match"), toolBin("c"), 1, true, nil},
+			},
+		},
+		{
+			name: "conflicting-positions",
+			cmd: &Command{
+				Add:      "bar",
+				Value:    "@",
+				Before:   "#",
+				Position: &zeroPosition,
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			err: &klib.Error{
+				ID:     "52e8fa5b-29d7-4007-b0a8-ee2eb1b2ad0e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+		{
+			// The existing element is not removed, so it is not moved.
+			name: "conflicting-positions-existing-element",
+			cmd: &Command{
+				Add:    "bar",
+				Value:  "@",
+				Before: "#",
+				After:  "$",
+			},
+			compareKey: "bar",
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"bar": {
+							key:                   "bar",
+							pathList:              true,
+							pathListElements:      []string{"#", "@", "$"},
+							pathListElementExists: map[string]bool{"#": true, "@": true, "$": true},
+						},
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "52e8fa5b-29d7-4007-b0a8-ee2eb1b2ad0e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
 			},
 		},
 	}
@@ -205,8 +519,8 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 			mockPathLoader := NewMockPathLoader(st)
 			mockPathHandler := NewMockPathHandler(st)
 
-			if len(tc.mockTemplateHandlerOn) > 0 {
-				on := tc.mockTemplateHandlerOn
+			for j := range tc.mockTemplateHandlerOn {
+				on := tc.mockTemplateHandlerOn[j]
 				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
 			}
 
@@ -217,7 +531,9 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 
 			for j := range tc.mockPathHandlerOn {
 				on := tc.mockPathHandlerOn[j]
-				mockPathHandler.On(on[0].(string), on[1], on[2], on[3]).Return(on[4])
+				method := on[0].(string)
+				n := pathHandlerArgs[method] + 1
+				mockPathHandler.On(method, on[1:n]...).Return(on[n:]...)
 			}
 
 			tc.commandMethods.templateHandler = mockTemplateHandler
@@ -242,14 +558,66 @@ func Test_defaultCommandMethods_Add(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("position-symlinked-match", func(st *testing.T) {
+		if runtime.GOOS == "windows" {
+			st.Skip("symlinks need privileges")
+		}
+
+		dir := st.TempDir()
+
+		for _, name := range []string{"v1", "v2"} {
+			if err := os.MkdirAll(filepath.Join(dir, name, "bin"), 0o755); err != nil {
+				st.Fatal(err)
+			}
+		}
+
+		if err := os.Symlink(filepath.Join(dir, "v1"), filepath.Join(dir, "a-current")); err != nil {
+			st.Fatal(err)
+		}
+
+		pathHandler := &defaultPathHandler{
+			caseSensitiveFilesystem: true,
+			resolveSymlinks:         true,
+		}
+
+		commandMethods := &defaultCommandMethods{
+			container: &container{
+				env: map[string]*environVar{},
+			},
+			pathHandler:     pathHandler,
+			pathLoader:      &defaultPathLoader{pathHandler: pathHandler},
+			templateHandler: &templateHandler{},
+		}
+
+		err := commandMethods.Add(&Command{
+			Add:      "PATH",
+			Value:    filepath.Join(dir, "*", "bin"),
+			Position: &zeroPosition,
+		})
+		if assert.NoError(st, err) {
+			assert.Equal(st, []string{
+				filepath.Join(dir, "a-current", "bin"),
+				filepath.Join(dir, "v2", "bin"),
+			}, commandMethods.container.env["PATH"].pathListElements, "Path list mismatch")
+		}
+	})
 }
 
 func Test_defaultCommandMethods_Set(t *testing.T) {
+	t.Setenv(conf.EnvKeyVar, base64.StdEncoding.EncodeToString(testKey(1)))
+
+	encrypted, err := encrypt(testKey(1), []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	testCases := []*struct {
 		name                  string
 		cmd                   *Command
 		commandMethods        *defaultCommandMethods
 		mockTemplateHandlerOn []any
+		mockSecretResolverOn  []any
 		err                   *klib.Error
 		wantEnv               map[string]*environVar
 	}{
@@ -319,68 +687,211 @@ func Test_defaultCommandMethods_Set(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for i := range testCases {
-		tc := testCases[i]
-
-		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
-			mockTemplateHandler := klib.NewMockStringHandler(st)
-
-			if len(tc.mockTemplateHandlerOn) > 0 {
-				on := tc.mockTemplateHandlerOn
-				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
-			}
-
-			tc.commandMethods.templateHandler = mockTemplateHandler
-
-			err := tc.commandMethods.Set(tc.cmd)
-			if klib.CheckTestError(st, err, tc.err) {
-				return
-			}
-
-			haveEnv := tc.commandMethods.container.env
-			wantEnv := tc.wantEnv
-
-			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
-				for k := range wantEnv {
-					have := haveEnv[k]
-					want := wantEnv[k]
-
-					assert.Equal(st, want, have, "Env[%q] mismatch", k)
-				}
-			}
-		})
-	}
-}
-
-func Test_defaultCommandMethods_Del(t *testing.T) {
-	keyA := strings.Join([]string{"1,2,3"}, string(os.PathListSeparator))
-	keyB := strings.Join([]string{"40,50,60"}, string(os.PathListSeparator))
-	keyC := strings.Join([]string{"700,800,900"}, string(os.PathListSeparator))
-
-	testCases := []*struct {
-		name           string
-		cmd            *Command
-		commandMethods *defaultCommandMethods
-		err            *klib.Error
-		wantEnv        map[string]*environVar
-	}{
 		{
-			name: "non-existing-key",
+			name: "secret",
 			cmd: &Command{
-				Del:   "foo",
-				Value: "bar",
+				Set:      "token",
+				Secret:   "github/token",
+				Provider: "pass",
+				file:     &File{trusted: true},
 			},
 			commandMethods: &defaultCommandMethods{
 				container: &container{
-					env: map[string]*environVar{
-						"a": {
-							originalValue:    "keyA",
-							currentValue:     keyA,
-							pathList:         true,
-							pathListElements: []string{"1", "2", "3"},
-							pathListElementExists: map[string]bool{
+					env: map[string]*environVar{},
+				},
+			},
+			mockSecretResolverOn: []any{"Resolve", "pass", "github/token", "s3cr3t", nil},
+			wantEnv: map[string]*environVar{
+				"token": {
+					key:          "token",
+					currentValue: "s3cr3t",
+					created:      true,
+					secret:       true,
+				},
+			},
+		},
+		{
+			name: "encrypted-value",
+			cmd: &Command{
+				Set:   "token",
+				Value: encrypted,
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"token": {
+					key:          "token",
+					currentValue: "s3cr3t",
+					created:      true,
+					secret:       true,
+				},
+			},
+		},
+		{
+			name: "encrypted-value-wrong-key",
+			cmd: &Command{
+				Set:   "token",
+				Value: encrypted,
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+				keys: &keySource{key: testKey(2), loaded: true},
+			},
+			err: &klib.Error{
+				ID:     "d58eb5f1-908b-42b9-abf3-22404c99b6af",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+		{
+			name: "encrypted-value-untrusted-file",
+			cmd: &Command{
+				Set:   "token",
+				Value: encrypted,
+				file:  &File{},
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			err: &klib.Error{
+				ID:     "1a352d46-0aeb-476c-8bcf-0ff950bfeb9f",
+				Status: http.StatusForbidden,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].value",
+			},
+		},
+		{
+			name: "secret-untrusted-file",
+			cmd: &Command{
+				Set:    "token",
+				Secret: "github/token",
+				file:   &File{},
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			err: &klib.Error{
+				ID:     "b9dee5ff-bdaa-411c-8c80-7305a44d0033",
+				Status: http.StatusForbidden,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].secret",
+			},
+		},
+		{
+			name: "secret-and-value",
+			cmd: &Command{
+				Set:    "token",
+				Value:  "bar",
+				Secret: "github/token",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			err: &klib.Error{
+				ID:     "d200aeca-6e00-4bc0-a934-466fc5a0d28a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0]",
+			},
+		},
+		{
+			name: "secret-without-providers",
+			cmd: &Command{
+				Set:    "token",
+				Secret: "github/token",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			err: &klib.Error{
+				ID:     "844fb0f9-10e0-4902-8ac0-41ac5ba4f4bd",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".commands[0].secret",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := klib.NewMockStringHandler(st)
+
+			if len(tc.mockTemplateHandlerOn) > 0 {
+				on := tc.mockTemplateHandlerOn
+				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
+			}
+
+			tc.commandMethods.templateHandler = mockTemplateHandler
+
+			if len(tc.mockSecretResolverOn) > 0 {
+				on := tc.mockSecretResolverOn
+				mockSecretResolver := NewMockSecretResolver(st)
+				mockSecretResolver.On(on[0].(string), on[1], on[2], mock.Anything).Return(on[3], on[4])
+				tc.commandMethods.secretResolver = mockSecretResolver
+			}
+
+			err := tc.commandMethods.Set(tc.cmd)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			haveEnv := tc.commandMethods.container.env
+			wantEnv := tc.wantEnv
+
+			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
+				for k := range wantEnv {
+					have := haveEnv[k]
+					want := wantEnv[k]
+
+					assert.Equal(st, want, have, "Env[%q] mismatch", k)
+				}
+			}
+		})
+	}
+}
+
+func Test_defaultCommandMethods_Del(t *testing.T) {
+	keyA := strings.Join([]string{"1,2,3"}, string(os.PathListSeparator))
+	keyB := strings.Join([]string{"40,50,60"}, string(os.PathListSeparator))
+	keyC := strings.Join([]string{"700,800,900"}, string(os.PathListSeparator))
+
+	testCases := []*struct {
+		name           string
+		cmd            *Command
+		commandMethods *defaultCommandMethods
+		err            *klib.Error
+		wantEnv        map[string]*environVar
+	}{
+		{
+			name: "non-existing-key",
+			cmd: &Command{
+				Del:   "foo",
+				Value: "bar",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"a": {
+							originalValue:    "keyA",
+							currentValue:     keyA,
+							pathList:         true,
+							pathListElements: []string{"1", "2", "3"},
+							pathListElementExists: map[string]bool{
 								"1": true,
 								"2": true,
 								"3": true,
@@ -635,3 +1146,627 @@ func Test_defaultCommandMethods_Del(t *testing.T) {
 		})
 	}
 }
+
+func Test_defaultCommandMethods_Default(t *testing.T) {
+	testCases := []*struct {
+		name                  string
+		cmd                   *Command
+		commandMethods        *defaultCommandMethods
+		mockTemplateHandlerOn []any
+		err                   *klib.Error
+		wantEnv               map[string]*environVar
+	}{
+		{
+			name: "create",
+			cmd: &Command{
+				Default: "foo",
+				Value:   "bar",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "bar", "barOK", nil},
+			wantEnv: map[string]*environVar{
+				"foo": {
+					key:          "foo",
+					currentValue: "barOK",
+					created:      true,
+				},
+			},
+		},
+		{
+			name: "set-empty",
+			cmd: &Command{
+				Default: "foo",
+				Value:   "bar",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"foo": {
+							key: "foo",
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "bar", "barOK", nil},
+			wantEnv: map[string]*environVar{
+				"foo": {
+					key:          "foo",
+					currentValue: "barOK",
+				},
+			},
+		},
+		{
+			name: "keep-existing-case-insensitive",
+			cmd: &Command{
+				Default: "foo",
+				Value:   "bar",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					caseInsensitiveEnvironment: true,
+					env: map[string]*environVar{
+						"FOO": {
+							key:          "Foo",
+							currentValue: "-",
+						},
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				"FOO": {
+					key:          "Foo",
+					currentValue: "-",
+				},
+			},
+		},
+		{
+			name: "set-deleted",
+			cmd: &Command{
+				Default: "foo",
+				Value:   "bar",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"foo": {
+							key:          "foo",
+							currentValue: "-",
+							delete:       true,
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "bar", "barOK", nil},
+			wantEnv: map[string]*environVar{
+				"foo": {
+					key:          "foo",
+					currentValue: "barOK",
+				},
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := klib.NewMockStringHandler(st)
+
+			if len(tc.mockTemplateHandlerOn) > 0 {
+				on := tc.mockTemplateHandlerOn
+				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
+			}
+
+			tc.commandMethods.templateHandler = mockTemplateHandler
+
+			err := tc.commandMethods.Default(tc.cmd)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			haveEnv := tc.commandMethods.container.env
+			wantEnv := tc.wantEnv
+
+			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
+				for k := range wantEnv {
+					have := haveEnv[k]
+					want := wantEnv[k]
+
+					assert.Equal(st, want, have, "Env[%q] mismatch", k)
+				}
+			}
+		})
+	}
+}
+
+func Test_defaultCommandMethods_Extend(t *testing.T) {
+	testCases := []*struct {
+		name                  string
+		cmd                   *Command
+		commandMethods        *defaultCommandMethods
+		mockTemplateHandlerOn []any
+		err                   *klib.Error
+		wantEnv               map[string]*environVar
+	}{
+		{
+			name: "create",
+			cmd: &Command{
+				Extend: "JAVA_OPTS",
+				Value:  "-Xmx2g",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "-Xmx2g", "-Xmx2g", nil},
+			wantEnv: map[string]*environVar{
+				"JAVA_OPTS": {
+					key:          "JAVA_OPTS",
+					currentValue: "-Xmx2g",
+					created:      true,
+				},
+			},
+		},
+		{
+			name: "encrypted-value",
+			cmd: &Command{
+				Extend: "JAVA_OPTS",
+				Value:  EncryptedPrefix + "Zm9v",
+			},
+			commandMethods: &defaultCommandMethods{},
+			err: &klib.Error{
+				ID:     "8d6164ed-78ca-46a9-a361-ace3ba20611a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].value",
+			},
+		},
+		{
+			name: "prepend-keep-existing-tokens",
+			cmd: &Command{
+				Extend: "CFLAGS",
+				Value:  "-O2 -g",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"CFLAGS": {
+							key:          "CFLAGS",
+							currentValue: "-Wall  -g",
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "-O2 -g", "-O2 -g", nil},
+			wantEnv: map[string]*environVar{
+				"CFLAGS": {
+					key:          "CFLAGS",
+					currentValue: "-O2 -g -Wall -g",
+				},
+			},
+		},
+		{
+			name: "append-repeated-flag",
+			cmd: &Command{
+				Extend: "CFLAGS",
+				Value:  "-I /opt/x/include",
+				Append: true,
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"CFLAGS": {
+							key:          "CFLAGS",
+							currentValue: "-I /usr/include",
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "-I /opt/x/include", "-I /opt/x/include", nil},
+			wantEnv: map[string]*environVar{
+				"CFLAGS": {
+					key:          "CFLAGS",
+					currentValue: "-I /usr/include -I /opt/x/include",
+				},
+			},
+		},
+		{
+			name: "skip-existing-value",
+			cmd: &Command{
+				Extend: "CFLAGS",
+				Value:  "-I  /opt/x/include",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"CFLAGS": {
+							key:          "CFLAGS",
+							currentValue: "-O2 -I /opt/x/include -g",
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "-I  /opt/x/include", "-I  /opt/x/include", nil},
+			wantEnv: map[string]*environVar{
+				"CFLAGS": {
+					key:          "CFLAGS",
+					currentValue: "-O2 -I /opt/x/include -g",
+				},
+			},
+		},
+		{
+			name: "append-custom-separator",
+			cmd: &Command{
+				Extend:    "GOPRIVATE",
+				Value:     "example.com/*",
+				Separator: ",",
+				Append:    true,
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"GOPRIVATE": {
+							key:          "GOPRIVATE",
+							currentValue: "example.org/*",
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "example.com/*", "example.com/*", nil},
+			wantEnv: map[string]*environVar{
+				"GOPRIVATE": {
+					key:          "GOPRIVATE",
+					currentValue: "example.org/*,example.com/*",
+				},
+			},
+		},
+		{
+			name: "path-list",
+			cmd: &Command{
+				Extend: "PATH",
+				Value:  "foo",
+			},
+			commandMethods: &defaultCommandMethods{
+				container: &container{
+					env: map[string]*environVar{
+						"PATH": {
+							key:      "PATH",
+							pathList: true,
+						},
+					},
+				},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "foo", "foo", nil},
+			err: &klib.Error{
+				ID:     "5d8bc519-6048-4192-a37f-3cff31ffc0f7",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := klib.NewMockStringHandler(st)
+
+			if len(tc.mockTemplateHandlerOn) > 0 {
+				on := tc.mockTemplateHandlerOn
+				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
+			}
+
+			tc.commandMethods.templateHandler = mockTemplateHandler
+
+			err := tc.commandMethods.Extend(tc.cmd)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			haveEnv := tc.commandMethods.container.env
+			wantEnv := tc.wantEnv
+
+			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
+				for k := range wantEnv {
+					have := haveEnv[k]
+					want := wantEnv[k]
+
+					assert.Equal(st, want, have, "Env[%q] mismatch", k)
+				}
+			}
+		})
+	}
+}
+
+func Test_defaultCommandMethods_Require(t *testing.T) {
+	dir := t.TempDir()
+
+	testCases := []*struct {
+		name                  string
+		cmd                   *Command
+		env                   map[string]*environVar
+		mockTemplateHandlerOn []any
+		err                   *klib.Error
+	}{
+		{
+			name: "set",
+			cmd: &Command{
+				Require: "foo",
+				Check:   RequireCheckSet,
+			},
+			env: map[string]*environVar{
+				"foo": {},
+			},
+		},
+		{
+			name: "not-set",
+			cmd: &Command{
+				Require: "foo",
+				Check:   RequireCheckSet,
+				index:   2,
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: "bar",
+					delete:       true,
+				},
+			},
+			err: &klib.Error{
+				ID:     "8528c69f-7cb4-4054-87d7-396347771d42",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".commands[2]",
+			},
+		},
+		{
+			name: "empty-with-message",
+			cmd: &Command{
+				Require: "GOPRIVATE",
+				Message: "GOPRIVATE must be set",
+			},
+			env: map[string]*environVar{
+				"GOPRIVATE": {},
+			},
+			mockTemplateHandlerOn: []any{"Handle", "GOPRIVATE must be set", "GOPRIVATE must be set", nil},
+			err: &klib.Error{
+				ID:     "d8c5ad81-66ff-4bfc-a6f2-0a99d0418861",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".commands[0]",
+			},
+		},
+		{
+			name: "match",
+			cmd: &Command{
+				Require: "foo",
+				Match:   "^v[0-9]+$",
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: "v12",
+				},
+			},
+		},
+		{
+			name: "mismatch",
+			cmd: &Command{
+				Require: "foo",
+				Match:   "^v[0-9]+$",
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: "12",
+				},
+			},
+			err: &klib.Error{
+				ID:     "710d54f3-8f1c-4815-a4c9-455a7f1d7500",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0]",
+			},
+		},
+		{
+			name: "invalid-match",
+			cmd: &Command{
+				Require: "foo",
+				Match:   "(",
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: "12",
+				},
+			},
+			err: &klib.Error{
+				ID:     "196d64fc-a5c5-4f4f-bac8-d0e87c403933",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeParseError,
+				Path:   ".commands[0].match",
+			},
+		},
+		{
+			name: "dir",
+			cmd: &Command{
+				Require: "foo",
+				Check:   RequireCheckDir,
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: dir,
+				},
+			},
+		},
+		{
+			name: "dir-not-file",
+			cmd: &Command{
+				Require: "foo",
+				Check:   RequireCheckFile,
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: dir,
+				},
+			},
+			err: &klib.Error{
+				ID:     "72030b77-3230-4ec1-a8b3-854003b154eb",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0]",
+			},
+		},
+		{
+			name: "missing-file",
+			cmd: &Command{
+				Require: "foo",
+				Check:   RequireCheckFile,
+			},
+			env: map[string]*environVar{
+				"foo": {
+					currentValue: dir + "/missing",
+				},
+			},
+			err: &klib.Error{
+				ID:     "cc82f3b0-fc78-42c4-b0be-e549d9126a8e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   ".commands[0]",
+			},
+		},
+		{
+			name: "unsupported-check",
+			cmd: &Command{
+				Require: "foo",
+				Check:   "unknown",
+			},
+			env: map[string]*environVar{},
+			err: &klib.Error{
+				ID:     "592fbdb3-9913-458a-b987-69151703204a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].check",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := klib.NewMockStringHandler(st)
+
+			if len(tc.mockTemplateHandlerOn) > 0 {
+				on := tc.mockTemplateHandlerOn
+				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
+			}
+
+			commandMethods := &defaultCommandMethods{
+				container: &container{
+					env: tc.env,
+				},
+				templateHandler: mockTemplateHandler,
+			}
+
+			err := commandMethods.Require(tc.cmd)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+		})
+	}
+}
+
+func Test_defaultCommandMethods_Echo(t *testing.T) {
+	file := &File{}
+
+	testCases := []*struct {
+		name                  string
+		cmd                   *Command
+		mockTemplateHandlerOn []any
+		err                   *klib.Error
+		wantNotices           []*notice
+	}{
+		{
+			name: "default-level",
+			cmd: &Command{
+				Echo: "Using {{ .go }}",
+				file: file,
+			},
+			mockTemplateHandlerOn: []any{"Handle", "Using {{ .go }}", "Using go1.22", nil},
+			wantNotices: []*notice{
+				{
+					level:   EchoLevelInfo,
+					message: "Using go1.22",
+					file:    file,
+				},
+			},
+		},
+		{
+			name: "warn",
+			cmd: &Command{
+				Echo:  "VPN required",
+				Level: EchoLevelWarn,
+			},
+			mockTemplateHandlerOn: []any{"Handle", "VPN required", "VPN required", nil},
+			wantNotices: []*notice{
+				{
+					level:   EchoLevelWarn,
+					message: "VPN required",
+				},
+			},
+		},
+		{
+			name: "unsupported-level",
+			cmd: &Command{
+				Echo:  "foo",
+				Level: "debug",
+				index: 1,
+			},
+			err: &klib.Error{
+				ID:     "fe1db2a3-e9a9-47f8-b7d5-d88191fb9f3e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[1].level",
+			},
+		},
+		{
+			name: "encrypted-message",
+			cmd: &Command{
+				Echo:  EncryptedPrefix + "Zm9v",
+				index: 2,
+			},
+			err: &klib.Error{
+				ID:     "8d6164ed-78ca-46a9-a361-ace3ba20611a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[2].echo",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := klib.NewMockStringHandler(st)
+
+			if len(tc.mockTemplateHandlerOn) > 0 {
+				on := tc.mockTemplateHandlerOn
+				mockTemplateHandler.On(on[0].(string), on[1]).Return(on[2], on[3])
+			}
+
+			commandMethods := &defaultCommandMethods{
+				templateHandler: mockTemplateHandler,
+			}
+
+			err := commandMethods.Echo(tc.cmd)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantNotices, commandMethods.notices, "Notices mismatch")
+		})
+	}
+}
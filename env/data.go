@@ -0,0 +1,201 @@
+package env
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/magiconair/properties"
+	"github.com/subosito/gotenv"
+	"go.katupy.io/klib"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// readDataFile reads and decodes the data file filename,
+// decrypting it with keys if its name ends with .enc.
+func readDataFile(filename, path string, keys *keySource) (map[string]any, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &klib.Error{
+				ID:     "145a329c-9fe2-493a-ac6f-e70603dae4ec",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   path,
+				Title:  "File not found",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"filepath": filename,
+				},
+			}
+		}
+
+		return nil, &klib.Error{
+			ID:     "96dbb73e-d7e4-4c65-aa2e-81ab2d8bf588",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Path:   path,
+			Title:  "Failed to read file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": filename,
+			},
+		}
+	}
+
+	format := filename
+
+	if strings.EqualFold(filepath.Ext(filename), EncryptedExt) {
+		key, err := keys.get()
+		if err != nil {
+			return nil, klib.ForwardError("e73dfe40-4910-463a-b1c3-d371784226e0", err)
+		}
+
+		b, err = decrypt(key, string(b), filename)
+		if err != nil {
+			return nil, klib.ForwardError("fe28cc5a-a80c-48b6-9fab-491f5c045254", err)
+		}
+
+		format = filename[:len(filename)-len(EncryptedExt)]
+	}
+
+	values, err := decodeData(b, format, path)
+	if err != nil {
+		return nil, klib.ForwardError("7e014293-e522-41ea-96c0-0f6c96a9951e", err)
+	}
+
+	return values, nil
+}
+
+// decodeData decodes the content b of the data file filename by its extension.
+// The values of .env and .properties files are strings, without variables
+// expanded, and so are the values of .ini files, which are grouped in a map
+// for each named section.
+func decodeData(b []byte, filename, path string) (map[string]any, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	values := make(map[string]any)
+
+	switch ext {
+	case ".toml":
+		if err := toml.Unmarshal(b, &values); err != nil {
+			return nil, &klib.Error{
+				ID:     "5705aeef-f9bb-45c8-815c-b8ca07bcaeda",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal toml file",
+				Cause:  err.Error(),
+			}
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &values); err != nil {
+			return nil, &klib.Error{
+				ID:     "c86e9b6f-a41c-4656-855e-7c6f6723efdd",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal yaml file",
+				Cause:  err.Error(),
+			}
+		}
+	case ".json":
+		if err := json.Unmarshal(b, &values); err != nil {
+			return nil, &klib.Error{
+				ID:     "b41f36c3-254d-4341-b942-2ebcb80fe421",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal json file",
+				Cause:  err.Error(),
+			}
+		}
+	case ".env":
+		// gotenv expands variables from the environment of xpdt, so dollar signs
+		// are hidden from it behind NUL, which env values cannot contain,
+		// and expansion is left to templates, as with .properties files.
+		b = bytes.ReplaceAll(b, []byte("$"), []byte("\x00"))
+
+		env, err := gotenv.StrictParse(bytes.NewReader(b))
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "4e14472c-92d1-4dc0-a880-0458d829694a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to parse env file",
+				Cause:  err.Error(),
+			}
+		}
+
+		for k, v := range env {
+			values[k] = strings.ReplaceAll(v, "\x00", "$")
+		}
+	case ".ini":
+		f, err := ini.Load(b)
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "b8977d67-8c22-470b-ba87-9c3b8f9d439a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to parse ini file",
+				Cause:  err.Error(),
+			}
+		}
+
+		for _, section := range f.Sections() {
+			sectionValues := values
+
+			if section.Name() != ini.DefaultSection {
+				sectionValues = make(map[string]any)
+				values[section.Name()] = sectionValues
+			}
+
+			for _, key := range section.Keys() {
+				sectionValues[key.Name()] = key.Value()
+			}
+		}
+	case ".properties":
+		// Expansion is left to templates.
+		loader := &properties.Loader{
+			Encoding:         properties.UTF8,
+			DisableExpansion: true,
+		}
+
+		p, err := loader.LoadBytes(b)
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "87720d10-97d0-4351-9e56-5ef590a00ada",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to parse properties file",
+				Cause:  err.Error(),
+			}
+		}
+
+		for k, v := range p.Map() {
+			values[k] = v
+		}
+	default:
+		return nil, &klib.Error{
+			ID:     "bfc8a1a2-dbbf-4da6-a4ad-89d059ca5054",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   path,
+			Detail: fmt.Sprintf("Unsupported data file extension %q.", ext),
+			Meta: map[string]any{
+				"filepath": filename,
+			},
+		}
+	}
+
+	return values, nil
+}
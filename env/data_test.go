@@ -0,0 +1,97 @@
+package env
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+)
+
+func Test_decodeData(t *testing.T) {
+	testCases := []*struct {
+		name     string
+		filename string
+		input    string
+		err      *klib.Error
+		want     map[string]any
+	}{
+		{
+			name:     "toml",
+			filename: "data.toml",
+			input:    "name = \"xpdt\"\n[db]\nport = 5432\n",
+			want:     map[string]any{"name": "xpdt", "db": map[string]any{"port": int64(5432)}},
+		},
+		{
+			name:     "yml",
+			filename: "data.YML",
+			input:    "name: xpdt\nports: [1, 2]\n",
+			want:     map[string]any{"name": "xpdt", "ports": []any{1, 2}},
+		},
+		{
+			name:     "json",
+			filename: "data.json",
+			input:    `{"name": "xpdt", "debug": true}`,
+			want:     map[string]any{"name": "xpdt", "debug": true},
+		},
+		{
+			name:     "invalid-json",
+			filename: "data.json",
+			input:    `{"name":`,
+			err: &klib.Error{
+				ID:     "b41f36c3-254d-4341-b942-2ebcb80fe421",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   ".env.data[x]",
+			},
+		},
+		{
+			name:     "env",
+			filename: ".env",
+			input:    "# comment\nexport NAME=xpdt\nGREETING=\"hello world\"\n",
+			want:     map[string]any{"NAME": "xpdt", "GREETING": "hello world"},
+		},
+		{
+			name:     "env-without-expansion",
+			filename: ".env",
+			input:    "FOO=$HOME\nBAR=\"${HOME}/bin\"\nBAZ='$FOO'\nPRICE=5$\n",
+			want:     map[string]any{"FOO": "$HOME", "BAR": "${HOME}/bin", "BAZ": "$FOO", "PRICE": "5$"},
+		},
+		{
+			name:     "ini",
+			filename: "data.ini",
+			input:    "name = xpdt\n; comment\n[db]\nport = 5432\n",
+			want:     map[string]any{"name": "xpdt", "db": map[string]any{"port": "5432"}},
+		},
+		{
+			name:     "properties",
+			filename: "data.properties",
+			input:    "# comment\napp.name = xpdt\napp.home = ${HOME}\n",
+			want:     map[string]any{"app.name": "xpdt", "app.home": "${HOME}"},
+		},
+		{
+			name:     "unsupported-extension",
+			filename: "data.txt",
+			err: &klib.Error{
+				ID:     "bfc8a1a2-dbbf-4da6-a4ad-89d059ca5054",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.data[x]",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := decodeData([]byte(tc.input), tc.filename, ".env.data[x]")
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.want, have, "Data mismatch")
+		})
+	}
+}
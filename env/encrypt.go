@@ -0,0 +1,484 @@
+package env
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+// EncryptedPrefix starts encrypted values and the content of encrypted files,
+// followed by the base64 of the AES-GCM ciphertext.
+const EncryptedPrefix = "xpdt:v1:"
+
+// EncryptedExt ends the names of encrypted data files, after their
+// format extension, e.g. secrets.env.enc.
+const EncryptedExt = ".enc"
+
+// DefaultKeyFilename is the name of the key file
+// in the xpdt directory of the user config directory.
+const DefaultKeyFilename = "key"
+
+// keySource loads the key of encrypted files and values once, when needed,
+// from $XPDT_KEY, or else from the key file.
+type keySource struct {
+	keyFile string
+
+	key    []byte
+	err    error
+	loaded bool
+}
+
+func newKeySource(secrets *conf.Secrets) *keySource {
+	s := &keySource{}
+
+	if secrets != nil && secrets.KeyFile != "" {
+		s.keyFile = secrets.KeyFile
+	} else if globalDir := globalEnvDir(); globalDir != "" {
+		s.keyFile = filepath.Join(globalDir, DefaultKeyFilename)
+	}
+
+	return s
+}
+
+func (s *keySource) get() ([]byte, error) {
+	if !s.loaded {
+		s.key, s.err = s.load()
+		s.loaded = true
+	}
+
+	return s.key, s.err
+}
+
+func (s *keySource) load() ([]byte, error) {
+	encoded, source := os.Getenv(conf.EnvKeyVar), "$"+conf.EnvKeyVar
+
+	if encoded == "" {
+		if s.keyFile == "" {
+			return nil, &klib.Error{
+				ID:     "c219ab6c-96d2-472a-8f6c-c6f8bf0cf7aa",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Detail: fmt.Sprintf("There is no key to encrypt or decrypt, set $%s or secrets.keyFile.", conf.EnvKeyVar),
+			}
+		}
+
+		keyFile, err := expandTilde(s.keyFile)
+		if err != nil {
+			return nil, klib.ForwardError("f97bbd66-0911-449f-9474-e18fe066448b", err)
+		}
+
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, &klib.Error{
+					ID:     "a86b5cfb-1d2a-4d0a-af93-b7963f5e5053",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeNotFound,
+					Path:   ".secrets.keyFile",
+					Detail: fmt.Sprintf("There is no key to encrypt or decrypt, set $%s or create %s with xpdt secrets keygen.", conf.EnvKeyVar, keyFile),
+					Cause:  err.Error(),
+				}
+			}
+
+			return nil, &klib.Error{
+				ID:     "3f195c1e-d172-4c92-915d-7a3fa60370d4",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeFileError,
+				Path:   ".secrets.keyFile",
+				Title:  "Failed to read key file",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"filepath": keyFile,
+				},
+			}
+		}
+
+		encoded, source = string(b), keyFile
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err == nil && len(key) != keySize {
+		err = fmt.Errorf("key must be %d bytes, got %d", keySize, len(key))
+	}
+
+	if err != nil {
+		return nil, &klib.Error{
+			ID:     "76cb8388-6387-45d9-a7ec-9c0a6ad4f564",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Detail: fmt.Sprintf("Invalid key in %s, it must be the base64 of %d random bytes.", source, keySize),
+			Cause:  err.Error(),
+		}
+	}
+
+	return key, nil
+}
+
+// isEncrypted returns whether value is an encrypted value.
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), EncryptedPrefix)
+}
+
+// encrypt returns plaintext encrypted with key.
+func encrypt(key, plaintext []byte) (string, error) {
+	ciphertext, err := seal(key, plaintext)
+	if err != nil {
+		return "", &klib.Error{
+			ID:     "70c24c7c-7eb5-418d-b267-eac832596b41",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Title:  "Failed to encrypt",
+			Cause:  err.Error(),
+		}
+	}
+
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt returns the plaintext of value, encrypted with key.
+// The name tells what is decrypted in errors.
+func decrypt(key []byte, value, name string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(value), EncryptedPrefix)
+	if !ok {
+		return nil, &klib.Error{
+			ID:     "a899e2e8-27ab-449f-8068-9d30523eac2d",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeParseError,
+			Detail: fmt.Sprintf("Cannot decrypt %s, it must start with %s.", name, EncryptedPrefix),
+		}
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, &klib.Error{
+			ID:     "3d004c28-9575-429b-b166-3f5f2e51547a",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeParseError,
+			Detail: fmt.Sprintf("Cannot decrypt %s, it is not valid base64 after %s.", name, EncryptedPrefix),
+			Cause:  err.Error(),
+		}
+	}
+
+	plaintext, err := open(key, ciphertext)
+	if err != nil {
+		return nil, &klib.Error{
+			ID:     "d58eb5f1-908b-42b9-abf3-22404c99b6af",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Detail: fmt.Sprintf("Failed to decrypt %s, the key is wrong or the content is corrupted.", name),
+			Cause:  err.Error(),
+		}
+	}
+
+	return plaintext, nil
+}
+
+// Crypter encrypts and decrypts files and values
+// with the key of the configuration.
+type Crypter struct {
+	config *conf.Config
+	keys   *keySource
+}
+
+func NewCrypter(config *conf.Config) *Crypter {
+	return &Crypter{
+		config: config,
+		keys:   newKeySource(config.Secrets),
+	}
+}
+
+// GenerateKey writes a random key to the key file, and returns its path.
+// An existing key file is never replaced.
+func (c *Crypter) GenerateKey() (string, error) {
+	if c.keys.keyFile == "" {
+		return "", &klib.Error{
+			ID:     "792c1a9e-02ed-4ab6-8cd7-9a40a31bf001",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+			Path:   ".secrets.keyFile",
+			Detail: "There is no key file to write to.",
+		}
+	}
+
+	keyFile, err := expandTilde(c.keys.keyFile)
+	if err != nil {
+		return "", klib.ForwardError("17d6ac2b-f2db-482a-809d-638959e687a6", err)
+	}
+
+	if _, err := os.Stat(keyFile); err == nil {
+		return "", &klib.Error{
+			ID:     "5e806c0b-9f02-4b80-acce-c43a4c21d449",
+			Status: http.StatusConflict,
+			Code:   klib.CodeInvalidValue,
+			Path:   ".secrets.keyFile",
+			Detail: fmt.Sprintf("Key file %s already exists.", keyFile),
+		}
+	}
+
+	key := make([]byte, keySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", &klib.Error{
+			ID:     "65722150-811a-4d5f-9b35-a3b27f8b2b5f",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Title:  "Failed to generate key",
+			Cause:  err.Error(),
+		}
+	}
+
+	if err := writePrivateFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n")); err != nil {
+		return "", &klib.Error{
+			ID:     "2e5a2b86-5915-41a2-a598-f29cbf62bb15",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to write key file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": keyFile,
+			},
+		}
+	}
+
+	return keyFile, nil
+}
+
+// EncryptValue returns value encrypted, to be used as a command value.
+func (c *Crypter) EncryptValue(value string) (string, error) {
+	key, err := c.keys.get()
+	if err != nil {
+		return "", klib.ForwardError("59e7c197-ba40-4c96-99b9-64d12eb2d0b0", err)
+	}
+
+	encrypted, err := encrypt(key, []byte(value))
+	if err != nil {
+		return "", klib.ForwardError("3fd31f5d-9ded-430a-bc4a-b0b55dbd6cd2", err)
+	}
+
+	return encrypted, nil
+}
+
+// DecryptValue returns the plaintext of an encrypted value.
+func (c *Crypter) DecryptValue(value string) (string, error) {
+	key, err := c.keys.get()
+	if err != nil {
+		return "", klib.ForwardError("130132a7-605f-4205-9c26-788a27253edf", err)
+	}
+
+	plaintext, err := decrypt(key, value, "value")
+	if err != nil {
+		return "", klib.ForwardError("a8df795a-d03e-4490-9d8f-a157af3efb59", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// EncryptFile encrypts filename to filename.enc, and returns its path.
+func (c *Crypter) EncryptFile(filename string) (string, error) {
+	b, err := readFileBytes(filename)
+	if err != nil {
+		return "", klib.ForwardError("d665dfa7-81dc-452a-839f-f57a3093734f", err)
+	}
+
+	encryptedFilename := filename + EncryptedExt
+
+	if err := c.writeEncryptedFile(encryptedFilename, b); err != nil {
+		return "", klib.ForwardError("92c9e123-3803-4270-88eb-051aecc291f9", err)
+	}
+
+	return encryptedFilename, nil
+}
+
+// DecryptFile writes the plaintext of the encrypted file filename to w.
+func (c *Crypter) DecryptFile(filename string, w io.Writer) error {
+	b, err := readFileBytes(filename)
+	if err != nil {
+		return klib.ForwardError("6956fd6c-fcb8-4d06-afba-89254cc3cd1b", err)
+	}
+
+	key, err := c.keys.get()
+	if err != nil {
+		return klib.ForwardError("60e1fc1b-c099-4b3c-9bec-f3b205256c1b", err)
+	}
+
+	plaintext, err := decrypt(key, string(b), filename)
+	if err != nil {
+		return klib.ForwardError("6642b482-c789-4917-946f-19afa84dcdf8", err)
+	}
+
+	if _, err := w.Write(plaintext); err != nil {
+		return &klib.Error{
+			ID:     "d9f651b0-9de9-4b79-985a-6d6682030d81",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeBufferError,
+			Title:  "Failed to write plaintext",
+			Cause:  err.Error(),
+		}
+	}
+
+	return nil
+}
+
+// EditFile opens the plaintext of the encrypted file filename with editor,
+// and encrypts it back if it changed. The file is created if it does not exist.
+// The plaintext is only written to a private temporary file while editing.
+func (c *Crypter) EditFile(filename, editor string) error {
+	var plaintext []byte
+
+	if _, err := os.Stat(filename); err == nil {
+		buf := new(bytes.Buffer)
+
+		if err := c.DecryptFile(filename, buf); err != nil {
+			return klib.ForwardError("402ecd8d-8f8d-4c4c-b538-1f748096870e", err)
+		}
+
+		plaintext = buf.Bytes()
+	} else if _, err := c.keys.get(); err != nil {
+		return klib.ForwardError("029888ab-d10a-453f-8c28-7242669aae1f", err)
+	}
+
+	editorArgs := strings.Fields(editor)
+
+	if len(editorArgs) == 0 {
+		return &klib.Error{
+			ID:     "818a17c5-0f38-4982-b49e-9409a370e13c",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+			Detail: "There is no editor, set $VISUAL or $EDITOR.",
+		}
+	}
+
+	// Keep the format extension for syntax highlighting.
+	tmp, err := os.CreateTemp("", "xpdt-*-"+filepath.Base(strings.TrimSuffix(filename, EncryptedExt)))
+	if err != nil {
+		return &klib.Error{
+			ID:     "7f19ac01-20ea-4978-af0f-5e9be12c113d",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to create temporary file",
+			Cause:  err.Error(),
+		}
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err == nil {
+		_, err = tmp.Write(plaintext)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return &klib.Error{
+			ID:     "70adaba5-6e9a-4089-aa54-9ad00949314b",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to write temporary file",
+			Cause:  err.Error(),
+		}
+	}
+
+	cmd := exec.Command(editorArgs[0], append(editorArgs[1:], tmp.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return &klib.Error{
+			ID:     "41ce02d4-9306-4b60-89f6-25d57ac5a73f",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Detail: fmt.Sprintf("Editor %q failed.", editor),
+			Cause:  err.Error(),
+		}
+	}
+
+	edited, err := readFileBytes(tmp.Name())
+	if err != nil {
+		return klib.ForwardError("1dbf07d2-c206-42a6-b86d-9f132d2e06b4", err)
+	}
+
+	if plaintext != nil && bytes.Equal(edited, plaintext) {
+		return nil
+	}
+
+	if err := c.writeEncryptedFile(filename, edited); err != nil {
+		return klib.ForwardError("4754fbaf-8849-4e0e-acf8-5c9293b0d6e7", err)
+	}
+
+	return nil
+}
+
+// writeEncryptedFile writes plaintext encrypted to filename.
+func (c *Crypter) writeEncryptedFile(filename string, plaintext []byte) error {
+	key, err := c.keys.get()
+	if err != nil {
+		return klib.ForwardError("06ede113-e8a6-4643-9daf-d157744d7b4c", err)
+	}
+
+	encrypted, err := encrypt(key, plaintext)
+	if err != nil {
+		return klib.ForwardError("1c90ad9a-772d-44b6-a95a-ec65fd44cf89", err)
+	}
+
+	if err := os.WriteFile(filename, []byte(encrypted+"\n"), 0o644); err != nil {
+		return &klib.Error{
+			ID:     "d5013b25-6c02-403c-9c84-8d36370f9f2b",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to write file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": filename,
+			},
+		}
+	}
+
+	return nil
+}
+
+// readFileBytes reads filename, with klib errors.
+func readFileBytes(filename string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &klib.Error{
+				ID:     "ed1cd307-e53b-4621-bd70-3b057ca90ea9",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Title:  "File not found",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"filepath": filename,
+				},
+			}
+		}
+
+		return nil, &klib.Error{
+			ID:     "ba9cd283-c987-4424-a222-2e5631965ef2",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to read file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": filename,
+			},
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,227 @@
+package env
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func Test_decrypt(t *testing.T) {
+	encrypted, err := encrypt(testKey(1), []byte("s3cr3t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []*struct {
+		name  string
+		key   []byte
+		value string
+		err   *klib.Error
+		want  string
+	}{
+		{
+			name:  "valid",
+			key:   testKey(1),
+			value: encrypted + "\n",
+			want:  "s3cr3t",
+		},
+		{
+			name:  "wrong-key",
+			key:   testKey(2),
+			value: encrypted,
+			err: &klib.Error{
+				ID:     "d58eb5f1-908b-42b9-abf3-22404c99b6af",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+		{
+			name:  "not-encrypted",
+			key:   testKey(1),
+			value: "s3cr3t",
+			err: &klib.Error{
+				ID:     "a899e2e8-27ab-449f-8068-9d30523eac2d",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeParseError,
+			},
+		},
+		{
+			name:  "invalid-base64",
+			key:   testKey(1),
+			value: EncryptedPrefix + "!",
+			err: &klib.Error{
+				ID:     "3d004c28-9575-429b-b166-3f5f2e51547a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeParseError,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := decrypt(tc.key, tc.value, "value")
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.want, string(have), "Plaintext mismatch")
+		})
+	}
+}
+
+func Test_keySource_get(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(testKey(1))+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []*struct {
+		name    string
+		envKey  string
+		keyFile string
+		err     *klib.Error
+		want    []byte
+	}{
+		{
+			name:    "key-file",
+			keyFile: keyFile,
+			want:    testKey(1),
+		},
+		{
+			name:    "env-var-over-key-file",
+			envKey:  base64.StdEncoding.EncodeToString(testKey(2)),
+			keyFile: keyFile,
+			want:    testKey(2),
+		},
+		{
+			name:    "missing-key-file",
+			keyFile: filepath.Join(dir, "missing"),
+			err: &klib.Error{
+				ID:     "a86b5cfb-1d2a-4d0a-af93-b7963f5e5053",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   ".secrets.keyFile",
+			},
+		},
+		{
+			name:   "short-key",
+			envKey: base64.StdEncoding.EncodeToString([]byte("short")),
+			err: &klib.Error{
+				ID:     "76cb8388-6387-45d9-a7ec-9c0a6ad4f564",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			st.Setenv(conf.EnvKeyVar, tc.envKey)
+
+			s := newKeySource(&conf.Secrets{KeyFile: tc.keyFile})
+
+			have, err := s.get()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.want, have, "Key mismatch")
+		})
+	}
+}
+
+func TestCrypter(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "cfg", "key")
+	t.Setenv(conf.EnvKeyVar, "")
+
+	crypter := NewCrypter(&conf.Config{
+		Secrets: &conf.Secrets{KeyFile: keyFile},
+	})
+
+	if _, err := crypter.GenerateKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := crypter.GenerateKey()
+	klib.CheckTestError(t, err, &klib.Error{
+		ID:     "5e806c0b-9f02-4b80-acce-c43a4c21d449",
+		Status: http.StatusConflict,
+		Code:   klib.CodeInvalidValue,
+		Path:   ".secrets.keyFile",
+	})
+
+	filename := filepath.Join(dir, "team.env")
+
+	if err := os.WriteFile(filename, []byte("TOKEN=s3cr3t\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedFilename, err := crypter.EncryptFile(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, filename+EncryptedExt, encryptedFilename, "Encrypted filename mismatch")
+
+	b, err := os.ReadFile(encryptedFilename)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, string(b), "s3cr3t", "File is not encrypted")
+	}
+
+	buf := new(bytes.Buffer)
+
+	if assert.NoError(t, crypter.DecryptFile(encryptedFilename, buf)) {
+		assert.Equal(t, "TOKEN=s3cr3t\n", buf.String(), "Plaintext mismatch")
+	}
+
+	values, err := readDataFile(encryptedFilename, ".dataFiles[team]", crypter.keys)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]any{"TOKEN": "s3cr3t"}, values, "Data mismatch")
+	}
+
+	if runtime.GOOS != "windows" {
+		// An editor that appends a line to the file.
+		editor := filepath.Join(dir, "editor")
+
+		if err := os.WriteFile(editor, []byte("#!/bin/sh\necho OTHER=value >> \"$1\"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if assert.NoError(t, crypter.EditFile(encryptedFilename, editor)) {
+			buf.Reset()
+
+			if assert.NoError(t, crypter.DecryptFile(encryptedFilename, buf)) {
+				assert.Equal(t, "TOKEN=s3cr3t\nOTHER=value\n", buf.String(), "Edited plaintext mismatch")
+			}
+		}
+	}
+
+	encrypted, err := crypter.EncryptValue("hunter2")
+	if assert.NoError(t, err) {
+		have, err := crypter.DecryptValue(encrypted)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hunter2", have, "Value mismatch")
+		}
+	}
+}
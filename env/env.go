@@ -1,13 +1,23 @@
 package env
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"go.katupy.io/klib"
 
 	"go.katupy.io/xpdt/conf"
@@ -17,6 +27,10 @@ const (
 	ZshHook = `function _xpdt_env_load() {
 	local _CMD_SET="SET"
 	local _CMD_DEL="DEL"
+	local _CMD_ALIAS="ALIAS"
+	local _CMD_UNALIAS="UNALIAS"
+	local _CMD_FUNC="FUNC"
+	local _CMD_UNFUNC="UNFUNC"
 	local _OP_READ_CMD=1
 	local _OP_READ_KEY=2
 	local _OP_READ_VALUE=3
@@ -25,7 +39,7 @@ const (
 	local KEY=""
 	local OP=$_OP_READ_CMD
 
-	echo "$(%s env load)" | while read line; do
+	echo "$(%s env load --shell zsh)" | while read -r line; do
 		case $OP in
 		$_OP_READ_CMD)
 			CMD="$line"
@@ -35,17 +49,36 @@ const (
 			KEY="$line"
 
 			case $CMD in
-			$_CMD_SET)
+			$_CMD_SET|$_CMD_ALIAS|$_CMD_FUNC)
 				OP=$_OP_READ_VALUE
 				;;
 			$_CMD_DEL)
 				unset "$KEY"
 				OP=$_OP_READ_CMD
 				;;
+			$_CMD_UNALIAS)
+				unalias "$KEY" 2>/dev/null
+				OP=$_OP_READ_CMD
+				;;
+			$_CMD_UNFUNC)
+				unfunction "$KEY" 2>/dev/null
+				OP=$_OP_READ_CMD
+				;;
 			esac
 			;;
 		$_OP_READ_VALUE)
-			export "$KEY"="$line"
+			case $CMD in
+			$_CMD_SET)
+				export "$KEY"="$line"
+				;;
+			$_CMD_ALIAS)
+				alias -- "$KEY"="${(g::)line}"
+				;;
+			$_CMD_FUNC)
+				functions[$KEY]="${(g::)line}"
+				;;
+			esac
+
 			OP=$_OP_READ_CMD
 			;;
 		esac
@@ -61,29 +94,206 @@ function cd() {
 	PowerShellHook = ``
 )
 
-type Command struct {
-	Declare string `toml:"declare,omitempty" yaml:"declare,omitempty"`
-	Value   string `toml:"value,omitempty" yaml:"value,omitempty"`
+// Stores of the reversal state.
+const (
+	ReverseStoreEnv  = "env"
+	ReverseStoreFile = "file"
+)
+
+// reverseFilePrefix starts the value of the reverse env var
+// when it references a reverse file by its ID.
+const reverseFilePrefix = "file:"
+
+// reverseFileMaxAge is how long a reverse file is kept since it was last
+// written or applied, about as long as a shell is left unused, while
+// $XDG_RUNTIME_DIR is removed when the user session ends. Reverse files are
+// not removed when they are applied, since subshells inherit the same
+// reverse env var.
+const reverseFileMaxAge = 24 * time.Hour
 
-	Add string `toml:"add,omitempty" yaml:"add,omitempty"`
-	Del string `toml:"del,omitempty" yaml:"del,omitempty"`
-	Set string `toml:"set,omitempty" yaml:"set,omitempty"`
+// reverseV1Prefix starts a reverse encoded as gzipped JSON in base64.
+// A reverse without a version prefix is plain JSON, as written by
+// earlier versions.
+const reverseV1Prefix = "v1:"
 
-	Platform string `toml:"platform,omitempty" yaml:"platform,omitempty"`
-	URI      string `toml:"uri,omitempty" yaml:"uri,omitempty"`
-	Append   bool   `toml:"append,omitempty" yaml:"append,omitempty"`
+// What is done with keys changed since xpdt last set them,
+// when the reverse is applied.
+const (
+	DriftReconcile = "reconcile"
+	DriftPreserve  = "preserve"
+	DriftReverse   = "reverse"
+)
+
+// Commands of the reverse recording the value xpdt last set a key to,
+// as a value, a path list, or the HMAC of a secret with the session key,
+// or that xpdt deleted the key, which has no value.
+// They precede the reversal of the key, and are not recorded if drift
+// is reversed anyway.
+const (
+	reverseLast     = "LAST"
+	reverseLastPath = "LASTPATH"
+	reverseLastSum  = "LASTSUM"
+	reverseLastDel  = "LASTDEL"
+)
+
+// Levels supported by the echo command.
+const (
+	EchoLevelInfo = "info"
+	EchoLevelWarn = "warn"
+)
+
+// Checks supported by the require command.
+const (
+	RequireCheckSet      = "set"
+	RequireCheckNonEmpty = "nonEmpty"
+	RequireCheckFile     = "file"
+	RequireCheckDir      = "dir"
+)
+
+type Command struct {
+	Declare string `toml:"declare,omitempty" yaml:"declare,omitempty" json:"declare,omitempty"`
+	Value   string `toml:"value,omitempty" yaml:"value,omitempty" json:"value,omitempty"`
+
+	Add string `toml:"add,omitempty" yaml:"add,omitempty" json:"add,omitempty"`
+	Del string `toml:"del,omitempty" yaml:"del,omitempty" json:"del,omitempty"`
+	Set string `toml:"set,omitempty" yaml:"set,omitempty" json:"set,omitempty"`
+
+	// Default sets a key only if it is unset or empty.
+	Default string `toml:"default,omitempty" yaml:"default,omitempty" json:"default,omitempty"`
+
+	// Secret sets or defaults a key to the secret of this key, resolved
+	// by Provider, which may be omitted if a single provider is configured.
+	Secret   string `toml:"secret,omitempty" yaml:"secret,omitempty" json:"secret,omitempty"`
+	Provider string `toml:"provider,omitempty" yaml:"provider,omitempty" json:"provider,omitempty"`
+
+	// Extend prepends, or appends, tokens to a plain string key,
+	// unless it already has all of them in the same order.
+	// Tokens are split by Separator, which defaults to a space.
+	Extend    string `toml:"extend,omitempty" yaml:"extend,omitempty" json:"extend,omitempty"`
+	Separator string `toml:"separator,omitempty" yaml:"separator,omitempty" json:"separator,omitempty"`
+
+	// Require validates a key with Check, and optionally Match,
+	// failing the load with Message if the key is invalid.
+	Require string `toml:"require,omitempty" yaml:"require,omitempty" json:"require,omitempty"`
+	Check   string `toml:"check,omitempty" yaml:"check,omitempty" json:"check,omitempty"`
+	Match   string `toml:"match,omitempty" yaml:"match,omitempty" json:"match,omitempty"`
+	Message string `toml:"message,omitempty" yaml:"message,omitempty" json:"message,omitempty"`
+
+	// Echo shows a message with Level when the file joins the chain.
+	Echo  string `toml:"echo,omitempty" yaml:"echo,omitempty" json:"echo,omitempty"`
+	Level string `toml:"level,omitempty" yaml:"level,omitempty" json:"level,omitempty"`
+
+	// Include loads the commands of another file at this point.
+	// Relative paths are resolved from the including file.
+	Include string `toml:"include,omitempty" yaml:"include,omitempty" json:"include,omitempty"`
+
+	Platform string `toml:"platform,omitempty" yaml:"platform,omitempty" json:"platform,omitempty"`
+	URI      string `toml:"uri,omitempty" yaml:"uri,omitempty" json:"uri,omitempty"`
+	Append   bool   `toml:"append,omitempty" yaml:"append,omitempty" json:"append,omitempty"`
+
+	// Where to insert path list elements, relative to an existing
+	// element (Before and After) or at an explicit index (Position).
+	// Negative positions count from the end of the list.
+	Before   string `toml:"before,omitempty" yaml:"before,omitempty" json:"before,omitempty"`
+	After    string `toml:"after,omitempty" yaml:"after,omitempty" json:"after,omitempty"`
+	Position *int   `toml:"position,omitempty" yaml:"position,omitempty" json:"position,omitempty"`
+
+	// Whether path list values that do not exist should be ignored.
+	SkipMissing bool `toml:"skipMissing,omitempty" yaml:"skipMissing,omitempty" json:"skipMissing,omitempty"`
 
 	file  *File
 	index int
 }
 
+// path returns the path of cmd in its file.
+func (cmd *Command) path() string {
+	return fmt.Sprintf(".commands[%d]", cmd.index)
+}
+
+// filePath returns the path of the file that declares cmd.
+func (cmd *Command) filePath() string {
+	if cmd.file == nil {
+		return ""
+	}
+
+	return cmd.file.filepath
+}
+
 type File struct {
-	Root bool `toml:"root,omitempty" yaml:"root,omitempty"`
+	Root bool `toml:"root,omitempty" yaml:"root,omitempty" json:"root,omitempty"`
+
+	// Files whose commands are loaded before the commands of this file.
+	// Relative paths are resolved from this file.
+	Include []string `toml:"include,omitempty" yaml:"include,omitempty" json:"include,omitempty"`
+
+	// Template data of this file and its children, which may override it.
+	// Data files are resolved relative to this file.
+	Data      map[string]any    `toml:"data,omitempty" yaml:"data,omitempty" json:"data,omitempty"`
+	DataFiles map[string]string `toml:"dataFiles,omitempty" yaml:"dataFiles,omitempty" json:"dataFiles,omitempty"`
 
-	Commands []*Command `toml:"commands,omitempty" yaml:"commands,omitempty"`
+	Commands []*Command `toml:"commands,omitempty" yaml:"commands,omitempty" json:"commands,omitempty"`
+
+	// Hooks run when this file joins or leaves the chain.
+	OnEnter []*Hook `toml:"onEnter,omitempty" yaml:"onEnter,omitempty" json:"onEnter,omitempty"`
+	OnLeave []*Hook `toml:"onLeave,omitempty" yaml:"onLeave,omitempty" json:"onLeave,omitempty"`
+
+	// Shell aliases and functions defined while this file is in the chain.
+	Aliases   []*ShellDef `toml:"aliases,omitempty" yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	Functions []*ShellDef `toml:"functions,omitempty" yaml:"functions,omitempty" json:"functions,omitempty"`
 
 	dir      string
 	filepath string
+
+	// The file that included this file, if any.
+	includedBy *File
+
+	// Template data of the commands of this file,
+	// merged with the data of its parents.
+	data map[string]any
+
+	// Whether the templates of this file are not restricted.
+	trusted bool
+}
+
+// ShellDef is a shell alias or function.
+type ShellDef struct {
+	Name  string `toml:"name,omitempty" yaml:"name,omitempty" json:"name,omitempty"`
+	Value string `toml:"value,omitempty" yaml:"value,omitempty" json:"value,omitempty"`
+
+	// The shell this definition applies to, or all shells if empty.
+	Shell string `toml:"shell,omitempty" yaml:"shell,omitempty" json:"shell,omitempty"`
+}
+
+// Kinds of shell definitions, as used in the diff.
+const (
+	shellDefAlias    = "ALIAS"
+	shellDefFunction = "FUNC"
+)
+
+// shellDefState tracks a shell definition between loads.
+type shellDefState struct {
+	kind string
+	name string
+
+	// Value defined by the previous load, if any.
+	previousValue string
+	previous      bool
+
+	// Value defined by this load, if any.
+	currentValue string
+	current      bool
+}
+
+// chainFile is a file of the loaded chain, as tracked between loads.
+type chainFile struct {
+	Key string `json:"key"`
+	Dir string `json:"dir,omitempty"`
+}
+
+type notice struct {
+	level   string
+	message string
+	file    *File
 }
 
 type environVar struct {
@@ -105,6 +315,10 @@ type environVar struct {
 	// Whether this key was created by commands.
 	created bool
 
+	// Whether the value of this key is a secret,
+	// which must not be shown or recorded.
+	secret bool
+
 	// Whether this key should be deleted.
 	delete bool
 
@@ -123,6 +337,7 @@ type environVar struct {
 func (ev *environVar) resetAndDelete() {
 	ev.currentValue = ""
 	ev.delete = true
+	ev.secret = false
 
 	if ev.pathList {
 		ev.pathList = false
@@ -136,8 +351,72 @@ type container struct {
 
 	env map[string]*environVar
 
+	// Shell aliases and functions, keyed by kind and name.
+	shellDefs map[string]*shellDefState
+
 	diff    []string
 	reverse []string
+
+	// The dir where the reverse is written to a file,
+	// if it is not written to the env var.
+	reverseDir string
+
+	// What is done with keys changed since xpdt last set them.
+	drift string
+
+	// The key of the HMAC of secret values recorded in the reverse,
+	// or the file it is read from or created at when it is first needed.
+	sumKey     []byte
+	sumKeyPath string
+}
+
+// lastSet is the value xpdt last set a key to, as recorded in the reverse.
+type lastSet struct {
+	cmd   string
+	value string
+}
+
+// matches reports whether value is the value xpdt last set,
+// getting the key of the HMAC of secret values with sumKey.
+func (s *lastSet) matches(value string, sumKey func() []byte) bool {
+	if s.cmd == reverseLastSum {
+		key := sumKey()
+
+		return key != nil && hmac.Equal([]byte(valueSum(key, value)), []byte(s.value))
+	}
+
+	return s.value == value
+}
+
+// valueSum returns the HMAC recorded for a secret value,
+// so it cannot be guessed from the reverse without the key.
+func valueSum(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// lastSumKey returns the key of the HMAC of secret values, reading or
+// creating it once, or nil if there is none and secrets are not recorded.
+func (c *container) lastSumKey() []byte {
+	if c.sumKey != nil || c.sumKeyPath == "" {
+		return c.sumKey
+	}
+
+	key, err := readOrCreateKey(c.sumKeyPath)
+	if err != nil {
+		log.Debug().
+			Str("_label", "sessionKeyUnavailable").
+			Str("filepath", c.sumKeyPath).
+			Err(err).
+			Send()
+	}
+
+	c.sumKey = key
+	c.sumKeyPath = ""
+
+	return c.sumKey
 }
 
 func (c *container) loadEnviron(environ []string) error {
@@ -161,24 +440,57 @@ func (c *container) loadEnviron(environ []string) error {
 	return nil
 }
 
+// envVar returns the env var of key, creating it if necessary.
+// The env var is ensured not to be deleted.
+func (c *container) envVar(key string) *environVar {
+	keyName := key
+
+	if c.caseInsensitiveEnvironment {
+		keyName = strings.ToUpper(keyName)
+	}
+
+	envVar, haveVar := c.env[keyName]
+	if !haveVar {
+		envVar = &environVar{
+			key:     key,
+			created: true,
+		}
+		c.env[keyName] = envVar
+	}
+
+	// Ensure key persists if it was deleted before.
+	if envVar.delete {
+		envVar.delete = false
+	}
+
+	return envVar
+}
+
 func (c *container) applyReverse() error {
 	reverseVar, ok := c.env[conf.EnvReverseVar]
 	if !ok {
 		return nil
 	}
 
-	reverse := []string{}
+	value := reverseVar.originalValue
 
-	if err := json.Unmarshal([]byte(reverseVar.originalValue), &reverse); err != nil {
-		return &klib.Error{
-			ID:     "57221f4e-bf90-4998-81b9-2544447fcf33",
-			Status: http.StatusBadRequest,
-			Code:   klib.CodeSerializationError,
-			Detail: fmt.Sprintf("Env var %q has an invalid format.", conf.EnvReverseVar),
-			Cause:  err.Error(),
+	if id, ok := strings.CutPrefix(value, reverseFilePrefix); ok {
+		var err error
+
+		value, err = c.readReverseFile(id)
+		if err != nil {
+			return klib.ForwardError("c173b4ba-840a-4185-87d5-1dfe5db7030f", err)
 		}
 	}
 
+	reverse, err := decodeReverse(value)
+	if err != nil {
+		return klib.ForwardError("f75f25ff-a538-46bf-99c8-79c818dcacb5", err)
+	}
+
+	// The values xpdt last set, keyed like env.
+	last := make(map[string]*lastSet)
+
 	// Ensure this key will be deleted since it has been consumed.
 	// Later we will check if it should be recreated or not.
 	c.env[conf.EnvReverseVar].delete = true
@@ -195,13 +507,87 @@ func (c *container) applyReverse() error {
 
 		cmd := reverse[i]
 		key := reverse[i+1]
+
+		// Shell definitions are not env vars, and are
+		// reversed along with the value they were defined with.
+		if cmd == "UN"+shellDefAlias || cmd == "UN"+shellDefFunction {
+			if len(reverse) < i+3 {
+				return &klib.Error{
+					ID:     "545a7c72-9b69-4b92-8b49-d669cd27525a",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeMissingValue,
+					Detail: fmt.Sprintf("Cmd %q is missing a value.", conf.EnvReverseVar),
+				}
+			}
+
+			state := c.shellDef(cmd[2:], key)
+			state.previousValue = reverse[i+2]
+			state.previous = true
+			i += 2
+
+			continue
+		}
+
 		keyName := key
 
 		if c.caseInsensitiveEnvironment {
 			keyName = strings.ToUpper(key)
 		}
 
+		switch cmd {
+		case "SET", reverseLast, reverseLastPath, reverseLastSum:
+			if len(reverse) < i+3 {
+				return &klib.Error{
+					ID:     "a0349df1-d732-4255-8878-aebab9182029",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeMissingValue,
+					Detail: fmt.Sprintf("Cmd %q is missing a value.", conf.EnvReverseVar),
+				}
+			}
+		case "DEL", reverseLastDel:
+		default:
+			return &klib.Error{
+				ID:     "52b39360-02a8-4646-9b1e-2cfc75f7b025",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Detail: fmt.Sprintf("Unsupported command %q on key %q", cmd, key),
+			}
+		}
+
+		value := ""
+
+		switch cmd {
+		case reverseLast, reverseLastPath, reverseLastSum:
+			last[keyName] = &lastSet{
+				cmd:   cmd,
+				value: reverse[i+2],
+			}
+			i += 2
+
+			continue
+		case reverseLastDel:
+			last[keyName] = &lastSet{cmd: cmd}
+			i += 1
+
+			continue
+		case "SET":
+			value = reverse[i+2]
+			i += 2
+		case "DEL":
+			i += 1
+		}
+
 		envVar, haveVar := c.env[keyName]
+
+		if s, ok := last[keyName]; ok {
+			var keep bool
+
+			cmd, value, keep = c.reconcile(key, cmd, value, s, envVar, haveVar)
+			if keep {
+				continue
+			}
+		}
+
 		if !haveVar {
 			envVar = &environVar{key: key}
 			c.env[keyName] = envVar
@@ -209,33 +595,402 @@ func (c *container) applyReverse() error {
 
 		envVar.reversal = true
 
-		switch cmd {
-		case "SET":
+		if cmd == "SET" {
 			// Set the originalValue to ensure this reversal
 			// is propagated if the key changes again.
 
-			envVar.originalValue = reverse[i+2]
+			envVar.originalValue = value
 			envVar.currentValue = envVar.originalValue
-			i += 2
-		case "DEL":
+		} else {
 			envVar.delete = true
 			envVar.reversalDelete = true
 			envVar.originalValue = ""
 			envVar.currentValue = ""
-			i += 1
-		default:
-			return &klib.Error{
-				ID:     "52b39360-02a8-4646-9b1e-2cfc75f7b025",
+		}
+	}
+
+	return nil
+}
+
+// reconcile returns the reversal of key, a SET of value or a DEL,
+// given the value xpdt last set the key to, or that it deleted the key.
+// If the key was changed since, the change is preserved, or, for path lists,
+// merged into the reversal by only removing the elements added by xpdt.
+// keep is true if the current value of the key must be kept as it is,
+// in which case the value the key had before xpdt set it is dropped
+// from the reverse, and cannot be restored afterwards.
+func (c *container) reconcile(key, cmd, value string, last *lastSet, envVar *environVar, haveVar bool) (string, string, bool) {
+	if last.cmd == reverseLastDel {
+		// The key is unchanged while it is still absent.
+		if !haveVar {
+			return cmd, value, false
+		}
+	} else if haveVar && last.matches(envVar.originalValue, c.lastSumKey) {
+		return cmd, value, false
+	}
+
+	if c.drift == DriftReverse {
+		log.Debug().
+			Str("_label", "reverseDriftOverwritten").
+			Str("key", key).
+			Send()
+
+		return cmd, value, false
+	}
+
+	if c.drift == DriftPreserve || last.cmd != reverseLastPath || !haveVar {
+		log.Warn().
+			Str("_label", "reverseDriftPreserved").
+			Str("key", key).
+			Send()
+
+		return cmd, value, true
+	}
+
+	added := make(map[string]bool)
+
+	for _, element := range filepath.SplitList(last.value) {
+		added[element] = true
+	}
+
+	for _, element := range filepath.SplitList(value) {
+		delete(added, element)
+	}
+
+	elements := []string{}
+
+	for _, element := range filepath.SplitList(envVar.originalValue) {
+		if element != "" && !added[element] {
+			elements = append(elements, element)
+		}
+	}
+
+	log.Warn().
+		Str("_label", "reverseDriftReconciled").
+		Str("key", key).
+		Send()
+
+	if cmd == "DEL" && len(elements) == 0 {
+		return cmd, "", false
+	}
+
+	return "SET", strings.Join(elements, string(os.PathListSeparator)), false
+}
+
+// encodeReverse encodes reverse in the latest version.
+func encodeReverse(reverse []string) (string, error) {
+	b, err := json.Marshal(reverse)
+	if err != nil {
+		return "", &klib.Error{
+			ID:     "9924802b-ef25-4864-97e0-3f3d7ce9f907",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeSerializationError,
+			Title:  "Failed to serialize reverse env var",
+			Cause:  err.Error(),
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	gz, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
+
+	if _, err := gz.Write(b); err != nil {
+		return "", &klib.Error{
+			ID:     "79313cba-2e3c-4f75-8670-e0dcb88da01c",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeBufferError,
+			Title:  "Failed to compress reverse env var",
+			Cause:  err.Error(),
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return "", &klib.Error{
+			ID:     "66454841-fcca-4e02-a097-d581565e4c4c",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeBufferError,
+			Title:  "Failed to compress reverse env var",
+			Cause:  err.Error(),
+		}
+	}
+
+	return reverseV1Prefix + base64.RawStdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeReverse decodes a reverse of any version.
+func decodeReverse(value string) ([]string, error) {
+	b := []byte(value)
+
+	if encoded, ok := strings.CutPrefix(value, reverseV1Prefix); ok {
+		compressed, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "ec49ff6e-46ee-4292-854b-a05678fb6f43",
 				Status: http.StatusBadRequest,
-				Code:   klib.CodeInvalidValue,
-				Detail: fmt.Sprintf("Unsupported command %q on key %q", cmd, key),
+				Code:   klib.CodeSerializationError,
+				Detail: fmt.Sprintf("Env var %q has an invalid encoding.", conf.EnvReverseVar),
+				Cause:  err.Error(),
+			}
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err == nil {
+			b, err = io.ReadAll(gz)
+		}
+
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "33119ff0-267b-423d-945a-9797a402ed78",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Detail: fmt.Sprintf("Env var %q has an invalid compression.", conf.EnvReverseVar),
+				Cause:  err.Error(),
 			}
 		}
 	}
 
+	reverse := []string{}
+
+	if err := json.Unmarshal(b, &reverse); err != nil {
+		return nil, &klib.Error{
+			ID:     "57221f4e-bf90-4998-81b9-2544447fcf33",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeSerializationError,
+			Detail: fmt.Sprintf("Env var %q has an invalid format.", conf.EnvReverseVar),
+			Cause:  err.Error(),
+		}
+	}
+
+	return reverse, nil
+}
+
+// readReverseFile returns the reverse in the reverse file of id.
+// A missing file, e.g. after a reboot, has nothing to reverse.
+func (c *container) readReverseFile(id string) (string, error) {
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", &klib.Error{
+			ID:     "b64f3eb5-dc94-4132-a5d3-10f16ec541dc",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Detail: fmt.Sprintf("Env var %q has an invalid reverse file ID.", conf.EnvReverseVar),
+		}
+	}
+
+	dir, err := stateDir()
+	if err != nil {
+		return "", klib.ForwardError("a8d987b0-13bb-428a-92bf-e5189fce4470", err)
+	}
+
+	path := filepath.Join(dir, "reverse", id)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warn().
+				Str("_label", "reverseFileMissing").
+				Str("filepath", path).
+				Send()
+
+			return "[]", nil
+		}
+
+		return "", &klib.Error{
+			ID:     "1ea62736-8648-4d31-8b9e-39ddb708a151",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to read reverse file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": path,
+			},
+		}
+	}
+
+	// Keep reverse files of active sessions from being removed as stale.
+	now := time.Now()
+
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Debug().
+			Str("_label", "reverseFileNotTouched").
+			Str("filepath", path).
+			Err(err).
+			Send()
+	}
+
+	return string(b), nil
+}
+
+// writeReverseFile writes the serialized reverse b to its reverse file,
+// or refreshes the file if it exists, and returns the value
+// of the reverse env var that references it.
+func (c *container) writeReverseFile(b []byte) (string, error) {
+	// Reverse files are named by their content, so the same reverse is
+	// written once, and a reverse file never changes once it is referenced.
+	sum := sha256.Sum256(b)
+	id := hex.EncodeToString(sum[:16])
+	path := filepath.Join(c.reverseDir, id)
+
+	now := time.Now()
+
+	if err := os.Chtimes(path, now, now); err == nil {
+		return reverseFilePrefix + id, nil
+	}
+
+	if err := writePrivateFile(path, b); err != nil {
+		return "", &klib.Error{
+			ID:     "b4f635f0-733b-4472-9dd4-a02fe99160f7",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Title:  "Failed to write reverse file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": path,
+			},
+		}
+	}
+
+	removeStaleReverseFiles(c.reverseDir)
+
+	return reverseFilePrefix + id, nil
+}
+
+// removeStaleReverseFiles removes the reverse files of dir
+// that were not written or applied within reverseFileMaxAge.
+func removeStaleReverseFiles(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Debug().
+			Str("_label", "reverseFilesNotCleaned").
+			Str("dir", dir).
+			Err(err).
+			Send()
+
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < reverseFileMaxAge {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+
+		if err := os.Remove(path); err != nil {
+			log.Debug().
+				Str("_label", "reverseFileNotRemoved").
+				Str("filepath", path).
+				Err(err).
+				Send()
+		}
+	}
+}
+
+// stateDir returns the directory of the state of the user session,
+// under $XDG_RUNTIME_DIR, which is removed when the session ends.
+// There is no fallback, since state elsewhere would outlive the session.
+func stateDir() (string, error) {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if !filepath.IsAbs(runtimeDir) {
+		return "", &klib.Error{
+			ID:     "1add821e-b284-4692-9f88-ef374226e1cd",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+			Detail: "$XDG_RUNTIME_DIR must be set to an absolute path to store the state of the session.",
+		}
+	}
+
+	return filepath.Join(runtimeDir, "xpdt"), nil
+}
+
+// shellDef returns the state of a shell definition, creating it if necessary.
+func (c *container) shellDef(kind, name string) *shellDefState {
+	if c.shellDefs == nil {
+		c.shellDefs = make(map[string]*shellDefState)
+	}
+
+	id := kind + " " + name
+
+	state, ok := c.shellDefs[id]
+	if !ok {
+		state = &shellDefState{
+			kind: kind,
+			name: name,
+		}
+		c.shellDefs[id] = state
+	}
+
+	return state
+}
+
+// readChain returns the files of the previously loaded chain.
+// It must be called before applyReverse, which reverts the chain var.
+func (c *container) readChain() ([]*chainFile, error) {
+	chainVar, ok := c.env[conf.EnvChainVar]
+	if !ok || chainVar.currentValue == "" {
+		return nil, nil
+	}
+
+	chain := []*chainFile{}
+
+	if err := json.Unmarshal([]byte(chainVar.currentValue), &chain); err != nil {
+		return nil, &klib.Error{
+			ID:     "a18e28d4-5c29-4312-a078-696f566ce274",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeSerializationError,
+			Detail: fmt.Sprintf("Env var %q has an invalid format.", conf.EnvChainVar),
+			Cause:  err.Error(),
+		}
+	}
+
+	return chain, nil
+}
+
+// writeChain records the files of the loaded chain,
+// so the next load can detect which files joined or left it.
+func (c *container) writeChain(chain []*chainFile) error {
+	if len(chain) == 0 {
+		// The reversal of the previous load deletes the chain var.
+		return nil
+	}
+
+	b, err := json.Marshal(chain)
+	if err != nil {
+		return &klib.Error{
+			ID:     "2858faf7-497b-4a01-84f2-5d342e8ac25a",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeSerializationError,
+			Title:  "Failed to serialize chain env var",
+			Cause:  err.Error(),
+		}
+	}
+
+	c.envVar(conf.EnvChainVar).currentValue = string(b)
+
 	return nil
 }
 
+// environ returns the environment after all operations,
+// in the same format as os.Environ.
+func (c *container) environ() []string {
+	environ := make([]string, 0, len(c.env))
+
+	for _, envVar := range c.env {
+		if envVar.delete {
+			continue
+		}
+
+		value := envVar.currentValue
+
+		if envVar.pathList {
+			value = strings.Join(envVar.pathListElements, string(os.PathListSeparator))
+		}
+
+		environ = append(environ, envVar.key+"="+value)
+	}
+
+	return environ
+}
+
 func (c *container) makeDiff() {
 	c.diff = []string{}
 	c.reverse = []string{}
@@ -257,6 +1012,12 @@ func (c *container) makeDiff() {
 
 			// Only create a reversal for this deletion if it was not propagated from the previous env.
 			if !envVar.reversalDelete {
+				// Record the deletion, so setting the key
+				// afterwards is detected when it is reversed.
+				if c.drift != DriftReverse {
+					c.reverse = append(c.reverse, reverseLastDel, key)
+				}
+
 				c.reverse = append(c.reverse, "SET", key, envVar.originalValue)
 			}
 
@@ -283,6 +1044,20 @@ func (c *container) makeDiff() {
 
 		c.diff = append(c.diff, "SET", key, value)
 
+		// Record the value set, so changes made to it
+		// afterwards are detected when it is reversed.
+		switch {
+		case c.drift == DriftReverse:
+		case envVar.secret:
+			if sumKey := c.lastSumKey(); sumKey != nil {
+				c.reverse = append(c.reverse, reverseLastSum, key, valueSum(sumKey, value))
+			}
+		case envVar.pathList:
+			c.reverse = append(c.reverse, reverseLastPath, key, value)
+		default:
+			c.reverse = append(c.reverse, reverseLast, key, value)
+		}
+
 		// If this was originally a reversal, we must propagate it.
 		if envVar.reversalDelete {
 			c.reverse = append(c.reverse, "DEL", key)
@@ -297,6 +1072,19 @@ func (c *container) makeDiff() {
 		}
 	}
 
+	for _, state := range c.shellDefs {
+		switch {
+		case state.current:
+			if !state.previous || state.previousValue != state.currentValue {
+				c.diff = append(c.diff, state.kind, state.name, escapeShellDef(state.currentValue))
+			}
+
+			c.reverse = append(c.reverse, "UN"+state.kind, state.name, state.currentValue)
+		case state.previous:
+			c.diff = append(c.diff, "UN"+state.kind, state.name)
+		}
+	}
+
 	if reverseEnvVar == nil {
 		return
 	}
@@ -308,18 +1096,19 @@ func (c *container) makeDiff() {
 
 func (c *container) writeDiff(w io.Writer) error {
 	if len(c.reverse) > 0 {
-		b, err := json.Marshal(c.reverse)
+		reverse, err := encodeReverse(c.reverse)
 		if err != nil {
-			return &klib.Error{
-				ID:     "9924802b-ef25-4864-97e0-3f3d7ce9f907",
-				Status: http.StatusInternalServerError,
-				Code:   klib.CodeSerializationError,
-				Title:  "Failed to serialize reverse env var",
-				Cause:  err.Error(),
+			return klib.ForwardError("32639ba8-79f1-4f5b-a1d1-ad5e87cdc204", err)
+		}
+
+		if c.reverseDir != "" {
+			reverse, err = c.writeReverseFile([]byte(reverse))
+			if err != nil {
+				return klib.ForwardError("45c08809-a67f-4727-8843-63615ad2ef1b", err)
 			}
 		}
 
-		c.diff = append(c.diff, "SET", conf.EnvReverseVar, string(b))
+		c.diff = append(c.diff, "SET", conf.EnvReverseVar, reverse)
 	}
 
 	if _, err := fmt.Fprintln(w, strings.Join(c.diff, "\n")); err != nil {
@@ -334,3 +1123,9 @@ func (c *container) writeDiff(w io.Writer) error {
 
 	return nil
 }
+
+// escapeShellDef escapes backslashes and newlines in value,
+// so shell definitions spanning multiple lines fit in a single diff line.
+func escapeShellDef(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(value)
+}
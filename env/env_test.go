@@ -1,12 +1,16 @@
 package env
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.katupy.io/klib"
@@ -104,11 +108,22 @@ func Test_container_loadEnviron(t *testing.T) {
 }
 
 func Test_container_applyReverse(t *testing.T) {
+	reverseOf := func(reverse ...string) string {
+		b, _ := json.Marshal(reverse)
+
+		return string(b)
+	}
+
+	pathList := func(elements ...string) string {
+		return strings.Join(elements, string(os.PathListSeparator))
+	}
+
 	testCases := []*struct {
-		name      string
-		container *container
-		err       *klib.Error
-		wantEnv   map[string]*environVar
+		name          string
+		container     *container
+		err           *klib.Error
+		wantEnv       map[string]*environVar
+		wantShellDefs map[string]*shellDefState
 	}{
 		{
 			name: "serialization-error",
@@ -125,6 +140,21 @@ func Test_container_applyReverse(t *testing.T) {
 				Code:   klib.CodeSerializationError,
 			},
 		},
+		{
+			name: "invalid-reverse-file-id",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: "file:../../etc/passwd",
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "b64f3eb5-dc94-4132-a5d3-10f16ec541dc",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
 		{
 			name: "missing-key",
 			container: &container{
@@ -221,61 +251,605 @@ func Test_container_applyReverse(t *testing.T) {
 			},
 		},
 		{
-			name: "del",
+			name: "del",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: `["DEL","foo"]`,
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "bar-old",
+						currentValue:  "bar-old",
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: `["DEL","foo"]`,
+					delete:        true,
+				},
+				"foo": {
+					key:            "foo",
+					delete:         true,
+					reversal:       true,
+					reversalDelete: true,
+				},
+			},
+		},
+		{
+			name: "multiple-ops",
+			container: &container{
+				caseInsensitiveEnvironment: true,
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: `["DEL","FOO","SET","bar","foo"]`,
+					},
+					"FOO": {
+						key:           "FOO",
+						originalValue: "bar-old",
+						currentValue:  "bar-old",
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: `["DEL","FOO","SET","bar","foo"]`,
+					delete:        true,
+				},
+				"BAR": {
+					key:           "bar",
+					originalValue: "foo",
+					currentValue:  "foo",
+					reversal:      true,
+				},
+				"FOO": {
+					key:            "FOO",
+					delete:         true,
+					reversal:       true,
+					reversalDelete: true,
+				},
+			},
+		},
+		{
+			name: "shell-defs",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: `["UNALIAS","t","go test ./...","UNFUNC","mk","make"]`,
+					},
+				},
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: `["UNALIAS","t","go test ./...","UNFUNC","mk","make"]`,
+					delete:        true,
+				},
+			},
+			wantShellDefs: map[string]*shellDefState{
+				"ALIAS t": {
+					kind:          shellDefAlias,
+					name:          "t",
+					previousValue: "go test ./...",
+					previous:      true,
+				},
+				"FUNC mk": {
+					kind:          shellDefFunction,
+					name:          "mk",
+					previousValue: "make",
+					previous:      true,
+				},
+			},
+		},
+		{
+			name: "shell-def-missing-value",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: `["UNALIAS","t"]`,
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "545a7c72-9b69-4b92-8b49-d669cd27525a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+			},
+		},
+		{
+			name: "last-missing-value",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: `["LAST","foo"]`,
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "a0349df1-d732-4255-8878-aebab9182029",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+			},
+		},
+		{
+			name: "last-unchanged",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "bar",
+						currentValue:  "bar",
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "old",
+					currentValue:  "old",
+					reversal:      true,
+				},
+			},
+		},
+		{
+			name: "last-sum-unchanged",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTSUM", "foo", valueSum(testKey(1), "s3cr3t"), "DEL", "foo"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "s3cr3t",
+						currentValue:  "s3cr3t",
+					},
+				},
+				drift:  DriftReconcile,
+				sumKey: testKey(1),
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTSUM", "foo", valueSum(testKey(1), "s3cr3t"), "DEL", "foo"),
+					delete:        true,
+				},
+				"foo": {
+					key:            "foo",
+					delete:         true,
+					reversal:       true,
+					reversalDelete: true,
+				},
+			},
+		},
+		{
+			name: "last-sum-other-session-preserved",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTSUM", "foo", valueSum(testKey(2), "s3cr3t"), "DEL", "foo"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "s3cr3t",
+						currentValue:  "s3cr3t",
+					},
+				},
+				drift:  DriftReconcile,
+				sumKey: testKey(1),
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTSUM", "foo", valueSum(testKey(2), "s3cr3t"), "DEL", "foo"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "s3cr3t",
+					currentValue:  "s3cr3t",
+				},
+			},
+		},
+		{
+			name: "drift-preserved",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "mine",
+						currentValue:  "mine",
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "mine",
+					currentValue:  "mine",
+				},
+			},
+		},
+		{
+			name: "drift-unset-preserved",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTPATH", "foo", "/x", "SET", "foo", "/a"),
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTPATH", "foo", "/x", "SET", "foo", "/a"),
+					delete:        true,
+				},
+			},
+		},
+		{
+			name: "last-del-unchanged",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTDEL", "foo", "SET", "foo", "old"),
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTDEL", "foo", "SET", "foo", "old"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "old",
+					currentValue:  "old",
+					reversal:      true,
+				},
+			},
+		},
+		{
+			// A key deleted by xpdt and set again by hand is kept.
+			name: "last-del-drift-preserved",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTDEL", "foo", "SET", "foo", "old"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "mine",
+						currentValue:  "mine",
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTDEL", "foo", "SET", "foo", "old"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "mine",
+					currentValue:  "mine",
+				},
+			},
+		},
+		{
+			name: "drift-reversed",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: "mine",
+						currentValue:  "mine",
+					},
+				},
+				drift: DriftReverse,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LAST", "foo", "bar", "SET", "foo", "old"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "old",
+					currentValue:  "old",
+					reversal:      true,
+				},
+			},
+		},
+		{
+			name: "drift-path-list-reconciled",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTPATH", "PATH", pathList("/x", "/a", "/b"), "SET", "PATH", pathList("/a", "/b")),
+					},
+					"PATH": {
+						key:           "PATH",
+						originalValue: pathList("/u", "/x", "/a"),
+						currentValue:  pathList("/u", "/x", "/a"),
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTPATH", "PATH", pathList("/x", "/a", "/b"), "SET", "PATH", pathList("/a", "/b")),
+					delete:        true,
+				},
+				"PATH": {
+					key:           "PATH",
+					originalValue: pathList("/u", "/a"),
+					currentValue:  pathList("/u", "/a"),
+					reversal:      true,
+				},
+			},
+		},
+		{
+			name: "drift-created-path-list-reconciled",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTPATH", "foo", "/x", "DEL", "foo"),
+					},
+					"foo": {
+						key:           "foo",
+						originalValue: pathList("/u", "/x"),
+						currentValue:  pathList("/u", "/x"),
+					},
+				},
+				drift: DriftReconcile,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTPATH", "foo", "/x", "DEL", "foo"),
+					delete:        true,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "/u",
+					currentValue:  "/u",
+					reversal:      true,
+				},
+			},
+		},
+		{
+			name: "drift-path-list-preserved",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvReverseVar: {
+						originalValue: reverseOf("LASTPATH", "PATH", pathList("/x", "/a"), "SET", "PATH", "/a"),
+					},
+					"PATH": {
+						key:           "PATH",
+						originalValue: pathList("/u", "/x", "/a"),
+						currentValue:  pathList("/u", "/x", "/a"),
+					},
+				},
+				drift: DriftPreserve,
+			},
+			wantEnv: map[string]*environVar{
+				conf.EnvReverseVar: {
+					originalValue: reverseOf("LASTPATH", "PATH", pathList("/x", "/a"), "SET", "PATH", "/a"),
+					delete:        true,
+				},
+				"PATH": {
+					key:           "PATH",
+					originalValue: pathList("/u", "/x", "/a"),
+					currentValue:  pathList("/u", "/x", "/a"),
+				},
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			err := tc.container.applyReverse()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantShellDefs, tc.container.shellDefs, "Shell defs mismatch")
+
+			haveEnv := tc.container.env
+			wantEnv := tc.wantEnv
+
+			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
+				for k := range wantEnv {
+					have := haveEnv[k]
+					want := wantEnv[k]
+
+					assert.Equal(st, want, have, "Env[%q] value mismatch", k)
+				}
+			}
+		})
+	}
+}
+
+func Test_decodeReverse(t *testing.T) {
+	path := strings.Repeat("/usr/local/share/toolchain/bin:", 100)
+	reverse := []string{"SET", "PATH", path, "DEL", "foo"}
+
+	encoded, err := encodeReverse(reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(encoded, reverseV1Prefix), "Encoded reverse is not versioned")
+	assert.Less(t, len(encoded), len(path), "Encoded reverse is not compact")
+
+	testCases := []*struct {
+		name  string
+		value string
+		err   *klib.Error
+		want  []string
+	}{
+		{
+			name:  "v1",
+			value: encoded,
+			want:  reverse,
+		},
+		{
+			name:  "plain-json",
+			value: `["SET","foo","bar"]`,
+			want:  []string{"SET", "foo", "bar"},
+		},
+		{
+			name:  "invalid-encoding",
+			value: reverseV1Prefix + "!",
+			err: &klib.Error{
+				ID:     "ec49ff6e-46ee-4292-854b-a05678fb6f43",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+			},
+		},
+		{
+			name:  "invalid-compression",
+			value: reverseV1Prefix + "Zm9v",
+			err: &klib.Error{
+				ID:     "33119ff0-267b-423d-945a-9797a402ed78",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := decodeReverse(tc.value)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.want, have, "Reverse mismatch")
+		})
+	}
+}
+
+func Test_container_readChain(t *testing.T) {
+	testCases := []*struct {
+		name      string
+		container *container
+		err       *klib.Error
+		wantChain []*chainFile
+	}{
+		{
+			name: "no-chain",
+			container: &container{
+				env: map[string]*environVar{},
+			},
+		},
+		{
+			name: "invalid-chain",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvChainVar: {
+						currentValue: "[",
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "a18e28d4-5c29-4312-a078-696f566ce274",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+			},
+		},
+		{
+			name: "chain",
+			container: &container{
+				env: map[string]*environVar{
+					conf.EnvChainVar: {
+						currentValue: `[{"key":"a","dir":"/a","onLeave":[{"run":"echo bye"}]},{"key":"b"}]`,
+					},
+				},
+			},
+			// Hooks in the chain var are ignored, since anyone can set it.
+			wantChain: []*chainFile{
+				{
+					Key: "a",
+					Dir: "/a",
+				},
+				{
+					Key: "b",
+				},
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := tc.container.readChain()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantChain, have, "Chain mismatch")
+		})
+	}
+}
+
+func Test_container_writeChain(t *testing.T) {
+	testCases := []*struct {
+		name      string
+		container *container
+		chain     []*chainFile
+		err       *klib.Error
+		wantEnv   map[string]*environVar
+	}{
+		{
+			name: "empty-chain",
 			container: &container{
-				env: map[string]*environVar{
-					conf.EnvReverseVar: {
-						originalValue: `["DEL","foo"]`,
-					},
-					"foo": {
-						key:           "foo",
-						originalValue: "bar-old",
-						currentValue:  "bar-old",
-					},
-				},
-			},
-			wantEnv: map[string]*environVar{
-				conf.EnvReverseVar: {
-					originalValue: `["DEL","foo"]`,
-					delete:        true,
-				},
-				"foo": {
-					key:            "foo",
-					delete:         true,
-					reversal:       true,
-					reversalDelete: true,
-				},
+				env: map[string]*environVar{},
 			},
+			wantEnv: map[string]*environVar{},
 		},
 		{
-			name: "multiple-ops",
+			name: "reversal-deleted-chain",
 			container: &container{
-				caseInsensitiveEnvironment: true,
 				env: map[string]*environVar{
-					conf.EnvReverseVar: {
-						originalValue: `["DEL","FOO","SET","bar","foo"]`,
-					},
-					"FOO": {
-						key:           "FOO",
-						originalValue: "bar-old",
-						currentValue:  "bar-old",
+					conf.EnvChainVar: {
+						key:            conf.EnvChainVar,
+						delete:         true,
+						reversal:       true,
+						reversalDelete: true,
 					},
 				},
 			},
+			chain: []*chainFile{
+				{Key: "a"},
+			},
 			wantEnv: map[string]*environVar{
-				conf.EnvReverseVar: {
-					originalValue: `["DEL","FOO","SET","bar","foo"]`,
-					delete:        true,
-				},
-				"BAR": {
-					key:           "bar",
-					originalValue: "foo",
-					currentValue:  "foo",
-					reversal:      true,
-				},
-				"FOO": {
-					key:            "FOO",
-					delete:         true,
+				conf.EnvChainVar: {
+					key:            conf.EnvChainVar,
+					currentValue:   `[{"key":"a"}]`,
 					reversal:       true,
 					reversalDelete: true,
 				},
@@ -287,22 +861,12 @@ func Test_container_applyReverse(t *testing.T) {
 		tc := testCases[i]
 
 		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
-			err := tc.container.applyReverse()
+			err := tc.container.writeChain(tc.chain)
 			if klib.CheckTestError(st, err, tc.err) {
 				return
 			}
 
-			haveEnv := tc.container.env
-			wantEnv := tc.wantEnv
-
-			if assert.Equal(st, len(wantEnv), len(haveEnv), "Env length mismatch") {
-				for k := range wantEnv {
-					have := haveEnv[k]
-					want := wantEnv[k]
-
-					assert.Equal(st, want, have, "Env[%q] value mismatch", k)
-				}
-			}
+			assert.Equal(st, tc.wantEnv, tc.container.env, "Env mismatch")
 		})
 	}
 }
@@ -338,6 +902,7 @@ func Test_container_makeDiff(t *testing.T) {
 			},
 			wantReverse: []string{
 				"DEL", "foo",
+				"LAST", "foo", "bar",
 			},
 		},
 		{
@@ -355,6 +920,66 @@ func Test_container_makeDiff(t *testing.T) {
 			wantDiff: []string{
 				"SET", "foo", "",
 			},
+			wantReverse: []string{
+				"DEL", "foo",
+				"LAST", "foo", "",
+			},
+		},
+		{
+			name: "set-secret-entry",
+			container: &container{
+				env: map[string]*environVar{
+					"foo": {
+						key:           "foo",
+						originalValue: "bar",
+						currentValue:  "s3cr3t",
+						secret:        true,
+					},
+				},
+				sumKey: testKey(1),
+			},
+			wantDiff: []string{
+				"SET", "foo", "s3cr3t",
+			},
+			wantReverse: []string{
+				"SET", "foo", "bar",
+				"LASTSUM", "foo", valueSum(testKey(1), "s3cr3t"),
+			},
+		},
+		{
+			name: "set-secret-entry-without-session-key",
+			container: &container{
+				env: map[string]*environVar{
+					"foo": {
+						key:           "foo",
+						originalValue: "bar",
+						currentValue:  "s3cr3t",
+						secret:        true,
+					},
+				},
+			},
+			wantDiff: []string{
+				"SET", "foo", "s3cr3t",
+			},
+			wantReverse: []string{
+				"SET", "foo", "bar",
+			},
+		},
+		{
+			name: "set-entry-drift-reversed",
+			container: &container{
+				env: map[string]*environVar{
+					"foo": {
+						key:           "foo",
+						originalValue: "",
+						currentValue:  "bar",
+					},
+				},
+				drift: DriftReverse,
+			},
+			wantDiff: []string{
+				"SET", "foo", "bar",
+			},
 			wantReverse: []string{
 				"DEL", "foo",
 			},
@@ -370,6 +995,8 @@ func Test_container_makeDiff(t *testing.T) {
 							"set-entry-path-list",
 							strings.Join([]string{"bar1", "bar2", "bar3"}, string(os.PathListSeparator)),
 						),
+						pathList:         true,
+						pathListElements: []string{"bar1", "bar2", "bar3"},
 					},
 				},
 			},
@@ -378,6 +1005,7 @@ func Test_container_makeDiff(t *testing.T) {
 			},
 			wantReverse: []string{
 				"SET", "foo", "bar1",
+				"LASTPATH", "foo", cache.Get("set-entry-path-list"),
 			},
 		},
 		{
@@ -398,6 +1026,7 @@ func Test_container_makeDiff(t *testing.T) {
 			},
 			wantReverse: []string{
 				"DEL", "foo",
+				"LAST", "foo", "bar",
 			},
 		},
 		{
@@ -417,6 +1046,7 @@ func Test_container_makeDiff(t *testing.T) {
 			},
 			wantReverse: []string{
 				"SET", "foo", "bar-old",
+				"LAST", "foo", "bar",
 			},
 		},
 		{
@@ -434,6 +1064,27 @@ func Test_container_makeDiff(t *testing.T) {
 			wantDiff: []string{
 				"DEL", "foo",
 			},
+			wantReverse: []string{
+				"SET", "foo", "bar",
+				"LASTDEL", "foo",
+			},
+		},
+		{
+			name: "del-entry-drift-reversed",
+			container: &container{
+				env: map[string]*environVar{
+					"foo": {
+						key:           "foo",
+						originalValue: "bar",
+						currentValue:  "",
+						delete:        true,
+					},
+				},
+				drift: DriftReverse,
+			},
+			wantDiff: []string{
+				"DEL", "foo",
+			},
 			wantReverse: []string{
 				"SET", "foo", "bar",
 			},
@@ -559,32 +1210,109 @@ func Test_container_makeDiff(t *testing.T) {
 			},
 			wantReverse: []string{
 				"SET", "a", "1",
+				"LAST", "a", "3",
 				"SET", "c", "3",
+				"LAST", "c", "1",
 				"SET", "d", "4",
+				"LASTDEL", "d",
 				"DEL", "e",
+				"LAST", "e", "5",
 				"DEL", "f",
+				"LAST", "f", "",
 				"SET", "g", "6",
+				"LASTDEL", "g",
+			},
+		},
+		{
+			name: "shell-defs",
+			container: &container{
+				env: map[string]*environVar{},
+				shellDefs: map[string]*shellDefState{
+					"ALIAS new": {
+						kind:         shellDefAlias,
+						name:         "new",
+						currentValue: "go test ./...",
+						current:      true,
+					},
+					"ALIAS kept": {
+						kind:          shellDefAlias,
+						name:          "kept",
+						previousValue: "ls",
+						previous:      true,
+						currentValue:  "ls",
+						current:       true,
+					},
+					"FUNC changed": {
+						kind:          shellDefFunction,
+						name:          "changed",
+						previousValue: "echo a",
+						previous:      true,
+						currentValue:  "echo a\\\necho b",
+						current:       true,
+					},
+					"FUNC removed": {
+						kind:          shellDefFunction,
+						name:          "removed",
+						previousValue: "echo c",
+						previous:      true,
+					},
+				},
+			},
+			wantDiff: []string{
+				"ALIAS", "new", "go test ./...",
+				"FUNC", "changed", `echo a\\\necho b`,
+				"UNFUNC", "removed",
+			},
+			wantReverse: []string{
+				"UNALIAS", "kept", "ls",
+				"UNALIAS", "new", "go test ./...",
+				"UNFUNC", "changed", "echo a\\\necho b",
 			},
 		},
 	}
 
-	sortCmdsByKeys := func(slice []string) []string {
+	// Shell definitions are unset with their value in the reverse, but not in the diff.
+	sortCmdsByKeys := func(slice []string, reverse bool) []string {
 		keys := []string{}
 		cmds := make(map[string][]string)
 
 		for i := 0; i < len(slice); i++ {
 			cmd := slice[i]
 			key := slice[i+1]
-			keys = append(keys, key)
+			id := key
 
 			switch cmd {
 			case "SET":
-				cmds[key] = []string{"SET", key, slice[i+2]}
+				cmds[id] = []string{"SET", key, slice[i+2]}
 				i += 2
 			case "DEL":
-				cmds[key] = []string{"DEL", key}
+				cmds[id] = []string{"DEL", key}
+				i += 1
+			case "LAST", "LASTPATH", "LASTSUM":
+				id = key + " " + cmd
+				cmds[id] = []string{cmd, key, slice[i+2]}
+				i += 2
+			case "LASTDEL":
+				id = key + " " + cmd
+				cmds[id] = []string{cmd, key}
 				i += 1
+			case "ALIAS", "FUNC":
+				id = strings.TrimPrefix(cmd, "UN") + " " + key
+				cmds[id] = []string{cmd, key, slice[i+2]}
+				i += 2
+			case "UNALIAS", "UNFUNC":
+				id = strings.TrimPrefix(cmd, "UN") + " " + key
+
+				if reverse {
+					cmds[id] = []string{cmd, key, slice[i+2]}
+					i += 2
+				} else {
+					cmds[id] = []string{cmd, key}
+					i += 1
+				}
 			}
+
+			keys = append(keys, id)
 		}
 
 		sort.Strings(keys)
@@ -603,7 +1331,7 @@ func Test_container_makeDiff(t *testing.T) {
 		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
 			tc.container.makeDiff()
 
-			haveDiff := sortCmdsByKeys(tc.container.diff)
+			haveDiff := sortCmdsByKeys(tc.container.diff, false)
 			wantDiff := tc.wantDiff
 
 			if assert.Equal(st, len(wantDiff), len(haveDiff), "Diff length mismatch") {
@@ -615,7 +1343,7 @@ func Test_container_makeDiff(t *testing.T) {
 				}
 			}
 
-			haveReverse := sortCmdsByKeys(tc.container.reverse)
+			haveReverse := sortCmdsByKeys(tc.container.reverse, true)
 			wantReverse := tc.wantReverse
 
 			if assert.Equal(st, len(wantReverse), len(haveReverse), "Reverse length mismatch") {
@@ -629,3 +1357,233 @@ func Test_container_makeDiff(t *testing.T) {
 		})
 	}
 }
+
+func Test_container_reverseDriftPreserved(t *testing.T) {
+	reverse, err := json.Marshal([]string{"LAST", "foo", "bar", "SET", "foo", "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &container{
+		env: map[string]*environVar{
+			conf.EnvReverseVar: {
+				key:           conf.EnvReverseVar,
+				originalValue: string(reverse),
+				currentValue:  string(reverse),
+			},
+			"foo": {
+				key:           "foo",
+				originalValue: "mine",
+				currentValue:  "mine",
+			},
+		},
+		drift: DriftReconcile,
+	}
+
+	if err := c.applyReverse(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.makeDiff()
+
+	// The value foo had before xpdt set it is dropped with the preserved change,
+	// so it cannot be restored by a later reverse.
+	assert.Equal(t, []string{"DEL", conf.EnvReverseVar}, c.diff, "Diff mismatch")
+	assert.Empty(t, c.reverse, "Reverse mismatch")
+}
+
+func Test_container_lastSumKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xpdt", "session.key")
+	c := &container{sumKeyPath: path}
+
+	key := c.lastSumKey()
+	if !assert.Len(t, key, keySize, "Key length mismatch") {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "Key mode mismatch")
+	}
+
+	// Another load of the session uses the same key.
+	c = &container{sumKeyPath: path}
+	assert.Equal(t, key, c.lastSumKey(), "Key mismatch")
+
+	// Without session state, secrets are not recorded.
+	c = &container{}
+	assert.Nil(t, c.lastSumKey(), "Key mismatch")
+}
+
+func Test_container_reverseFile(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	dir, err := stateDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &container{
+		env: map[string]*environVar{
+			"foo": {
+				key:          "foo",
+				currentValue: "bar",
+			},
+		},
+		reverseDir: filepath.Join(dir, "reverse"),
+	}
+
+	c.makeDiff()
+
+	buf := new(bytes.Buffer)
+
+	if err := c.writeDiff(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	diff := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if !assert.Equal(t, []string{"SET", "foo", "bar", "SET", conf.EnvReverseVar}, diff[:len(diff)-1], "Diff mismatch") {
+		return
+	}
+
+	value := diff[len(diff)-1]
+
+	id, ok := strings.CutPrefix(value, reverseFilePrefix)
+	if !assert.True(t, ok, "Reverse %q is not a reverse file", value) {
+		return
+	}
+
+	path := filepath.Join(c.reverseDir, id)
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "Reverse file mode mismatch")
+	}
+
+	// Loading the same env again reuses its reverse file.
+	c.makeDiff()
+
+	buf.Reset()
+
+	if err := c.writeDiff(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(buf.String()), value), "Reverse file was not reused")
+
+	entries, err := os.ReadDir(c.reverseDir)
+	if assert.NoError(t, err) {
+		assert.Len(t, entries, 1, "Reverse files mismatch")
+	}
+
+	// Subshells inherit the same reverse env var, so each of them
+	// applies the same reverse file.
+	for i := 0; i < 2; i++ {
+		c := &container{
+			env: map[string]*environVar{
+				conf.EnvReverseVar: {
+					key:           conf.EnvReverseVar,
+					originalValue: value,
+					currentValue:  value,
+				},
+				"foo": {
+					key:           "foo",
+					originalValue: "bar",
+					currentValue:  "bar",
+				},
+			},
+			reverseDir: filepath.Join(dir, "reverse"),
+		}
+
+		if err := c.applyReverse(); !assert.NoError(t, err, "Container %d", i) {
+			return
+		}
+
+		assert.True(t, c.env["foo"].delete, "Container %d reverse was not applied", i)
+
+		c.makeDiff()
+
+		if err := c.writeDiff(new(bytes.Buffer)); !assert.NoError(t, err, "Container %d", i) {
+			return
+		}
+
+		_, err = os.Stat(path)
+		assert.NoError(t, err, "Container %d removed the applied reverse file", i)
+	}
+
+	// Stale reverse files are removed when a reverse file is written.
+	stale := time.Now().Add(-reverseFileMaxAge - time.Hour)
+
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.writeReverseFile([]byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "Stale reverse file was not removed")
+
+	// A reverse file that no longer exists has nothing to reverse.
+	c = &container{
+		env: map[string]*environVar{
+			conf.EnvReverseVar: {
+				key:           conf.EnvReverseVar,
+				originalValue: value,
+			},
+		},
+	}
+
+	if assert.NoError(t, c.applyReverse()) {
+		assert.Len(t, c.env, 1, "Env mismatch")
+	}
+}
+
+func Test_stateDir(t *testing.T) {
+	testCases := []*struct {
+		name       string
+		runtimeDir string
+		want       string
+		err        *klib.Error
+	}{
+		{
+			name:       "runtime-dir",
+			runtimeDir: "/run/user/1000",
+			want:       filepath.Join("/run/user/1000", "xpdt"),
+		},
+		{
+			name: "missing-runtime-dir",
+			err: &klib.Error{
+				ID:     "1add821e-b284-4692-9f88-ef374226e1cd",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+			},
+		},
+		{
+			name:       "relative-runtime-dir",
+			runtimeDir: "run",
+			err: &klib.Error{
+				ID:     "1add821e-b284-4692-9f88-ef374226e1cd",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			st.Setenv("XDG_RUNTIME_DIR", tc.runtimeDir)
+
+			have, err := stateDir()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.want, have, "State dir mismatch")
+		})
+	}
+}
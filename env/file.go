@@ -1,18 +1,91 @@
 package env
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/BurntSushi/toml"
 	"go.katupy.io/klib"
+	"gopkg.in/yaml.v3"
 )
 
+// chainKey returns the key that identifies file in the chain.
+// The same file may be applied to different directories by overwrites.
+func (f *File) chainKey() string {
+	return f.dir + string(os.PathListSeparator) + f.filepath
+}
+
+// chainMember returns the file of the chain that f belongs to,
+// which is f itself unless it was included by another file.
+func (f *File) chainMember() *File {
+	for f.includedBy != nil {
+		f = f.includedBy
+	}
+
+	return f
+}
+
+// decodeFile decodes the content b of filename by its extension.
+func decodeFile(b []byte, filename, path string) (*File, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	file := new(File)
+
+	switch ext {
+	case ".toml":
+		if err := toml.Unmarshal(b, file); err != nil {
+			return nil, &klib.Error{
+				ID:     "eaac6f84-4e1c-44de-a059-6821006d976a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal toml file",
+				Cause:  err.Error(),
+			}
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, file); err != nil {
+			return nil, &klib.Error{
+				ID:     "f7476e4b-e592-4f2c-ab97-cae327b957a4",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal yaml file",
+				Cause:  err.Error(),
+			}
+		}
+	case ".json":
+		if err := json.Unmarshal(b, file); err != nil {
+			return nil, &klib.Error{
+				ID:     "639e3678-fb47-4a05-8c35-b95022c83ac0",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeSerializationError,
+				Path:   path,
+				Title:  "Failed to unmarshal json file",
+				Cause:  err.Error(),
+			}
+		}
+	}
+
+	file.filepath = filename
+
+	return file, nil
+}
+
 type FileLoader interface {
 	Load(file *File) error
 }
 
 type defaultFileLoader struct {
+	platform      string
 	commandLoader CommandLoader
+
+	// Files being loaded, from the chain file to the deepest include.
+	loading []string
 }
 
 func (l *defaultFileLoader) Load(file *File) error {
@@ -29,11 +102,43 @@ func (l *defaultFileLoader) Load(file *File) error {
 		}
 	}
 
+	l.loading = nil
+
+	if err := l.load(file); err != nil {
+		return klib.ForwardError("a8f8e8b0-0262-44c7-bc9c-97fec79de41c", err)
+	}
+
+	return nil
+}
+
+// load loads the includes and the commands of file.
+func (l *defaultFileLoader) load(file *File) error {
+	l.loading = append(l.loading, file.filepath)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	for i := range file.Include {
+		if err := l.include(file, file.Include[i], fmt.Sprintf(".include[%d]", i)); err != nil {
+			return klib.ForwardError("a3f153b3-2dfd-4c27-b179-1b96f80d07c2", err)
+		}
+	}
+
 	for i := range file.Commands {
 		cmd := file.Commands[i]
 		cmd.file = file
 		cmd.index = i
 
+		if cmd.Include != "" {
+			if cmd.Platform != "" && cmd.Platform != l.platform {
+				continue
+			}
+
+			if err := l.include(file, cmd.Include, cmd.path()+".include"); err != nil {
+				return klib.ForwardError("1493d7c6-cb0f-484f-9182-1b11843c3308", err)
+			}
+
+			continue
+		}
+
 		if err := l.commandLoader.Load(cmd); err != nil {
 			return klib.ForwardError("f1b51039-fc62-4f06-b9c6-965a1b7dcc66", err)
 		}
@@ -41,3 +146,79 @@ func (l *defaultFileLoader) Load(file *File) error {
 
 	return nil
 }
+
+// include loads the file at filename, relative to the including file.
+// The included file applies to the directory of the including file.
+func (l *defaultFileLoader) include(file *File, filename, path string) error {
+	filename, err := expandTilde(strings.TrimSpace(filename))
+	if err != nil {
+		return klib.ForwardError("97762d10-22a2-4ff4-b072-dd812c78e6ef", err)
+	}
+
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(file.filepath), filename)
+	}
+
+	filename = filepath.Clean(filename)
+
+	for i := range l.loading {
+		if l.loading[i] == filename {
+			return &klib.Error{
+				ID:     "3130f752-c141-4f71-8c16-13395adacab1",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   path,
+				Detail: fmt.Sprintf("Include cycle: %s -> %s.", strings.Join(l.loading[i:], " -> "), filename),
+				Meta: map[string]any{
+					"filepath": file.filepath,
+				},
+			}
+		}
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &klib.Error{
+				ID:     "db126f66-ea88-44f5-855a-a6a4e6aa44d4",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   path,
+				Title:  "File not found",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"filepath": file.filepath,
+					"include":  filename,
+				},
+			}
+		}
+
+		return &klib.Error{
+			ID:     "da90f7ae-a092-4cd4-8094-54218d44c1a4",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFileError,
+			Path:   path,
+			Title:  "Failed to read file",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"filepath": file.filepath,
+				"include":  filename,
+			},
+		}
+	}
+
+	included, err := decodeFile(b, filename, "")
+	if err != nil {
+		return klib.ForwardError("a6dd96b6-a482-4d27-a51f-04edee119164", err)
+	}
+
+	included.dir = file.dir
+	included.includedBy = file
+	included.trusted = file.trusted
+
+	if err := l.load(included); err != nil {
+		return klib.ForwardError("92cc6e77-38b3-4ddf-9636-cc8f535269fc", err)
+	}
+
+	return nil
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/stretchr/testify/mock"
 	"go.katupy.io/klib"
 	"go.katupy.io/klib/mucache"
+	"go.katupy.io/klib/must"
 )
 
 func Test_defaultFileLoader_Load(t *testing.T) {
@@ -52,6 +55,61 @@ func Test_defaultFileLoader_Load(t *testing.T) {
 				{"Load", &Command{index: 2, file: cache.Get("ok")}, nil},
 			},
 		},
+		{
+			name: "include",
+			file: cache.SetGet(
+				"include",
+				&File{
+					dir:      ".",
+					filepath: must.FilepathAbs(filepath.Join("tests", "include", ".xpdt.toml")),
+					Include:  []string{"shared/go.toml"},
+					Commands: []*Command{
+						{},
+						{Include: "shared/common.toml", Platform: "none"},
+						{Include: "shared/common.toml"},
+					},
+				},
+			),
+			fileLoader: &defaultFileLoader{},
+			mockCommandLoaderOn: [][]any{
+				{"Load", matchIncludedCommand("COMMON", "shared/common.toml"), nil},
+				{"Load", matchIncludedCommand("GOFLAGS", "shared/go.toml"), nil},
+				{"Load", &Command{index: 0, file: cache.Get("include")}, nil},
+				{"Load", matchIncludedCommand("COMMON", "shared/common.toml"), nil},
+			},
+		},
+		{
+			name: "include-not-found",
+			file: &File{
+				dir:      ".",
+				filepath: must.FilepathAbs(filepath.Join("tests", "include", ".xpdt.toml")),
+				Commands: []*Command{
+					{Include: "missing.toml"},
+				},
+			},
+			fileLoader: &defaultFileLoader{},
+			err: &klib.Error{
+				ID:     "db126f66-ea88-44f5-855a-a6a4e6aa44d4",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   ".commands[0].include",
+			},
+		},
+		{
+			name: "include-cycle",
+			file: &File{
+				dir:      ".",
+				filepath: must.FilepathAbs(filepath.Join("tests", "include", ".xpdt.toml")),
+				Include:  []string{"cycle-a.toml"},
+			},
+			fileLoader: &defaultFileLoader{},
+			err: &klib.Error{
+				ID:     "3130f752-c141-4f71-8c16-13395adacab1",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".commands[0].include",
+			},
+		},
 	}
 
 	for i := range testCases {
@@ -62,7 +120,7 @@ func Test_defaultFileLoader_Load(t *testing.T) {
 
 			for j := range tc.mockCommandLoaderOn {
 				on := tc.mockCommandLoaderOn[j]
-				mockCommandLoader.On(on[0].(string), on[1]).Return(on[2])
+				mockCommandLoader.On(on[0].(string), on[1]).Return(on[2]).Once()
 			}
 
 			tc.fileLoader.commandLoader = mockCommandLoader
@@ -74,3 +132,14 @@ func Test_defaultFileLoader_Load(t *testing.T) {
 		})
 	}
 }
+
+// matchIncludedCommand matches the set command of key
+// declared by the included file at filename.
+func matchIncludedCommand(key, filename string) any {
+	return mock.MatchedBy(func(cmd *Command) bool {
+		return cmd.Set == key &&
+			cmd.file.dir == "." &&
+			cmd.file.filepath == must.FilepathAbs(filepath.Join("tests", "include", filename)) &&
+			cmd.file.includedBy != nil
+	})
+}
@@ -0,0 +1,270 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// Template functions about the filesystem and tooling.
+// Relative paths are resolved from the dir of the file being loaded.
+
+func readFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && info.Mode().IsRegular()
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && info.IsDir()
+}
+
+// findUp returns the path of name in the current dir or its closest parent,
+// or an empty string if there is none.
+func findUp(name string) (string, error) {
+	return findUpWithin(name, "")
+}
+
+// findUpWithin is like findUp, but does not go above ceilingDir, if not empty.
+func findUpWithin(name, ceilingDir string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, name)
+
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+
+		parentDir := filepath.Dir(dir)
+
+		if parentDir == dir || dir == ceilingDir {
+			return "", nil
+		}
+
+		dir = parentDir
+	}
+}
+
+// lookPath returns the path of the executable name in the dirs of pathList,
+// or an empty string if there is none. Unlike exec.LookPath,
+// it uses the path list being loaded, not the one of the process.
+func lookPath(name, pathList string) string {
+	exts := []string{""}
+
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		exts = filepath.SplitList(strings.ToLower(os.Getenv("PATHEXT")))
+	}
+
+	isExecutable := func(path string) bool {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return false
+		}
+
+		return runtime.GOOS == "windows" || info.Mode()&0o111 != 0
+	}
+
+	find := func(path string) string {
+		for _, ext := range exts {
+			if isExecutable(path + ext) {
+				return path + ext
+			}
+		}
+
+		return ""
+	}
+
+	if strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		return find(name)
+	}
+
+	for _, dir := range filepath.SplitList(pathList) {
+		if dir == "" {
+			continue
+		}
+
+		if path := find(filepath.Join(dir, name)); path != "" {
+			return path
+		}
+	}
+
+	return ""
+}
+
+// currentGitRoot returns the git root of the current dir,
+// or an empty string if it is not in a git repository.
+func currentGitRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	return findGitRoot(dir), nil
+}
+
+// currentGitBranch returns the branch checked out in the git repository
+// of the current dir, the commit if the HEAD is detached,
+// or an empty string if it is not in a git repository.
+func currentGitBranch() (string, error) {
+	gitRoot, err := currentGitRoot()
+	if err != nil || gitRoot == "" {
+		return "", err
+	}
+
+	gitDir := filepath.Join(gitRoot, ".git")
+
+	if fileExists(gitDir) {
+		// A worktree or submodule, with a "gitdir: <path>" file.
+		b, err := os.ReadFile(gitDir)
+		if err != nil {
+			return "", err
+		}
+
+		gitDir = strings.TrimSpace(strings.TrimPrefix(string(b), "gitdir:"))
+
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(gitRoot, gitDir)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+
+	head := strings.TrimSpace(string(b))
+
+	if ref, ok := strings.CutPrefix(head, "ref:"); ok {
+		return strings.TrimPrefix(strings.TrimSpace(ref), "refs/heads/"), nil
+	}
+
+	return head, nil
+}
+
+// restrictFuncs returns a copy of funcMap for untrusted files, where functions
+// with side effects are disabled, and the filesystem is confined to projectDir.
+func restrictFuncs(funcMap template.FuncMap, projectDir string) template.FuncMap {
+	restricted := make(template.FuncMap, len(funcMap))
+
+	for k, v := range funcMap {
+		restricted[k] = v
+	}
+
+	disabled := func(name string) func(...any) (string, error) {
+		return func(...any) (string, error) {
+			return "", fmt.Errorf("%s is not allowed in untrusted files", name)
+		}
+	}
+
+	// Network access.
+	restricted["getHostByName"] = disabled("getHostByName")
+
+	// The environment stays available, since env files commonly read it,
+	// and untrusted files cannot send it anywhere without hooks or network access.
+
+	if resolved, err := filepath.EvalSymlinks(projectDir); err == nil {
+		projectDir = resolved
+	}
+
+	// within returns whether path is in the project dir,
+	// after resolving its symlinks if it exists.
+	within := func(path string) bool {
+		abs, err := filepath.Abs(path)
+		if err != nil || projectDir == "" {
+			return false
+		}
+
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+
+		rel, err := filepath.Rel(projectDir, abs)
+
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	restricted["readFile"] = func(path string) (string, error) {
+		if !within(path) {
+			return "", fmt.Errorf("readFile of %s outside the project is not allowed in untrusted files", path)
+		}
+
+		return readFile(path)
+	}
+
+	restricted["fileExists"] = func(path string) bool {
+		return within(path) && fileExists(path)
+	}
+
+	restricted["dirExists"] = func(path string) bool {
+		return within(path) && dirExists(path)
+	}
+
+	restricted["glob"] = func(pattern string) ([]string, error) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		var allowed []string
+
+		for _, match := range matches {
+			if within(match) {
+				allowed = append(allowed, match)
+			}
+		}
+
+		return allowed, nil
+	}
+
+	restricted["findUp"] = func(name string) (string, error) {
+		if projectDir == "" {
+			return "", nil
+		}
+
+		path, err := findUpWithin(name, projectDir)
+		if err != nil || !within(path) {
+			return "", err
+		}
+
+		return path, nil
+	}
+
+	// The git repository may be outside the project.
+	restricted["gitRoot"] = func() (string, error) {
+		gitRoot, err := currentGitRoot()
+		if err != nil || !within(gitRoot) {
+			return "", err
+		}
+
+		return gitRoot, nil
+	}
+
+	restricted["gitBranch"] = func() (string, error) {
+		gitRoot, err := currentGitRoot()
+		if err != nil || !within(gitRoot) {
+			return "", err
+		}
+
+		return currentGitBranch()
+	}
+
+	return restricted
+}
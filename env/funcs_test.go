@@ -0,0 +1,212 @@
+package env
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+)
+
+// chdir changes the current dir to dir until the end of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func Test_findUp(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "a", "b")
+
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	chdir(t, sub)
+
+	testCases := []*struct {
+		name string
+		want string
+	}{
+		{name: "go.mod", want: filepath.Join(dir, "go.mod")},
+		{name: "b", want: filepath.Join(dir, "a", "b")},
+		{name: "missing.mod"},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := findUp(tc.name)
+			if assert.NoError(st, err) {
+				assert.Equal(st, tc.want, have, "Path mismatch")
+			}
+		})
+	}
+}
+
+func Test_lookPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("executables are looked up by PATHEXT")
+	}
+
+	dirA := t.TempDir()
+	dirB := t.TempDir()
+
+	for _, file := range []struct {
+		path string
+		mode os.FileMode
+	}{
+		{filepath.Join(dirA, "tool"), 0o644},
+		{filepath.Join(dirB, "tool"), 0o755},
+		{filepath.Join(dirA, "other"), 0o755},
+	} {
+		if err := os.WriteFile(file.path, nil, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pathList := dirA + string(os.PathListSeparator) + string(os.PathListSeparator) + dirB
+
+	testCases := []*struct {
+		name string
+		want string
+	}{
+		{name: "tool", want: filepath.Join(dirB, "tool")},
+		{name: "other", want: filepath.Join(dirA, "other")},
+		{name: filepath.Join(dirA, "other"), want: filepath.Join(dirA, "other")},
+		{name: filepath.Join(dirA, "tool")},
+		{name: "missing"},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			assert.Equal(st, tc.want, lookPath(tc.name, pathList), "Path mismatch")
+		})
+	}
+}
+
+func Test_currentGitBranch(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile(filepath.Join(dir, "repo", ".git", "HEAD"), "ref: refs/heads/feature/x\n")
+	writeFile(filepath.Join(dir, "detached", ".git", "HEAD"), "3f2c1e0\n")
+	writeFile(filepath.Join(dir, "worktree", ".git"), "gitdir: ../repo/.git/worktrees/wt\n")
+	writeFile(filepath.Join(dir, "repo", ".git", "worktrees", "wt", "HEAD"), "ref: refs/heads/wt\n")
+
+	if err := os.MkdirAll(filepath.Join(dir, "repo", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []*struct {
+		name string
+		dir  string
+		want string
+	}{
+		{name: "branch", dir: filepath.Join(dir, "repo", "sub"), want: "feature/x"},
+		{name: "detached", dir: filepath.Join(dir, "detached"), want: "3f2c1e0"},
+		{name: "worktree", dir: filepath.Join(dir, "worktree"), want: "wt"},
+		{name: "no-repo", dir: dir},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			chdir(st, tc.dir)
+
+			have, err := currentGitBranch()
+			if assert.NoError(st, err) {
+				assert.Equal(st, tc.want, have, "Branch mismatch")
+			}
+		})
+	}
+}
+
+func Test_restrictFuncs(t *testing.T) {
+	dir := t.TempDir()
+	projectDir := filepath.Join(dir, "project")
+	sub := filepath.Join(projectDir, "a")
+
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(dir, "secret"),
+		filepath.Join(dir, "go.mod"),
+		filepath.Join(projectDir, "config"),
+	} {
+		if err := os.WriteFile(path, []byte("value"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chdir(t, sub)
+
+	funcMap := restrictFuncs(klib.BaseFuncMap(), projectDir)
+
+	testCases := []*struct {
+		input  string
+		output string
+		err    bool
+	}{
+		{input: `{{ readFile "../config" }}`, output: "value"},
+		{input: `{{ readFile "../../secret" }}`, err: true},
+		{input: `{{ fileExists "../config" }}`, output: "true"},
+		{input: `{{ fileExists "../../secret" }}`, output: "false"},
+		{input: `{{ dirExists "../.." }}`, output: "false"},
+		{input: `{{ glob "../../*" | len }}`, output: "1"},
+		{input: `{{ findUp "config" }}`, output: filepath.Join(projectDir, "config")},
+		{input: `{{ findUp "go.mod" }}`, output: ""},
+		{input: `{{ getHostByName "localhost" }}`, err: true},
+		{input: `{{ upper "value" }}`, output: "VALUE"},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.input), func(st *testing.T) {
+			h := &templateHandler{
+				funcMap: funcMap,
+			}
+
+			have, err := h.Handle(tc.input)
+			if tc.err {
+				assert.Error(st, err)
+				return
+			}
+
+			if assert.NoError(st, err) {
+				assert.Equal(st, tc.output, have, "Template output mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package env
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.katupy.io/klib"
+)
+
+// findGitRoot returns the closest directory to dir, dir included,
+// that contains a .git entry, or an empty string if there is none.
+func findGitRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+
+		parentDir := filepath.Dir(dir)
+
+		if parentDir == dir {
+			return ""
+		}
+
+		dir = parentDir
+	}
+}
+
+// gitRemotes returns the normalized URLs of the remotes
+// of the git repository at dir.
+func gitRemotes(dir string) ([]string, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.Command("git", "-C", dir, "config", "--get-regexp", `^remote\..*\.url$`)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			// There are no remotes.
+			return nil, nil
+		}
+
+		return nil, &klib.Error{
+			ID:     "d47087de-659f-40a3-8220-ff1808cc8a33",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Title:  "Failed to get git remotes",
+			Detail: strings.TrimSpace(stderr.String()),
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"dir": dir,
+			},
+		}
+	}
+
+	var remotes []string
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) != 2 {
+			continue
+		}
+
+		remotes = append(remotes, normalizeGitRemote(fields[1]))
+	}
+
+	return remotes, nil
+}
+
+// normalizeGitRemote returns url without scheme, user and .git suffix,
+// so that the ssh and https URLs of a repository are the same,
+// e.g. github.com/katupy/xpdt for git@github.com:katupy/xpdt.git.
+func normalizeGitRemote(url string) string {
+	url = strings.TrimSpace(url)
+
+	scheme := strings.Index(url, "://")
+
+	if scheme >= 0 {
+		url = url[scheme+3:]
+	}
+
+	// With a scheme, the user may have a password after a colon,
+	// while in scp-like URLs a colon separates the host and path.
+	hostEnd := "/"
+
+	if scheme < 0 {
+		hostEnd = ":/"
+	}
+
+	if at := strings.Index(url, "@"); at >= 0 && at < strings.IndexAny(url+"/", hostEnd) {
+		url = url[at+1:]
+	}
+
+	if scheme < 0 {
+		// An scp-like URL, e.g. github.com:katupy/xpdt.
+		colon := strings.Index(url, ":")
+
+		if colon >= 0 && colon < strings.IndexAny(url+"/", "/") {
+			url = url[:colon] + "/" + url[colon+1:]
+		}
+	}
+
+	url = strings.TrimSuffix(url, "/")
+	url = strings.TrimSuffix(url, ".git")
+
+	return url
+}
@@ -0,0 +1,115 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"go.katupy.io/klib"
+)
+
+// DefaultHookTimeout is how long a hook may run when no timeout is configured.
+const DefaultHookTimeout = 5 * time.Second
+
+// Hook is a shell command run when a file joins or leaves the chain.
+type Hook struct {
+	Run      string `toml:"run,omitempty" yaml:"run,omitempty" json:"run"`
+	Timeout  string `toml:"timeout,omitempty" yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Platform string `toml:"platform,omitempty" yaml:"platform,omitempty" json:"platform,omitempty"`
+}
+
+type HookRunner interface {
+	Run(hook *Hook, dir string, environ []string) error
+}
+
+type defaultHookRunner struct {
+	platform string
+	timeout  time.Duration
+
+	// Where to write the output of hooks to.
+	// It must never be the diff output.
+	w io.Writer
+}
+
+func (r *defaultHookRunner) Run(hook *Hook, dir string, environ []string) error {
+	if hook.Platform != "" && hook.Platform != r.platform {
+		return nil
+	}
+
+	timeout := r.timeout
+
+	if hook.Timeout != "" {
+		d, err := time.ParseDuration(hook.Timeout)
+		if err != nil {
+			return &klib.Error{
+				ID:     "f36bd6d3-073c-4d75-b613-9fc9d0e40d79",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Detail: fmt.Sprintf("Invalid hook timeout %q.", hook.Timeout),
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"run": hook.Run,
+				},
+			}
+		}
+
+		timeout = d
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hook.Run)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", hook.Run)
+	}
+
+	cmd.Dir = dir
+	cmd.Env = environ
+	cmd.Stdout = r.w
+	cmd.Stderr = r.w
+
+	// Do not wait for background processes started by the hook
+	// that still hold its output after the timeout.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return &klib.Error{
+				ID:     "6041f4ed-30cc-441b-a1d0-85501ed206f3",
+				Status: http.StatusGatewayTimeout,
+				Code:   klib.CodeExecutionError,
+				Detail: fmt.Sprintf("Hook %q timed out after %s.", hook.Run, timeout),
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"dir": dir,
+				},
+			}
+		}
+
+		return &klib.Error{
+			ID:     "a9253731-abb5-4ccf-b99d-d5bca9a2d286",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Detail: fmt.Sprintf("Hook %q failed.", hook.Run),
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"dir": dir,
+			},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package env
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+)
+
+func Test_defaultHookRunner_Run(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+
+	testCases := []*struct {
+		name       string
+		hookRunner *defaultHookRunner
+		hook       *Hook
+		environ    []string
+		err        *klib.Error
+		wantOutput string
+	}{
+		{
+			name:       "skip-platform",
+			hookRunner: &defaultHookRunner{platform: "foo"},
+			hook: &Hook{
+				Run:      "echo skipped",
+				Platform: "not-foo",
+			},
+		},
+		{
+			name:       "output-and-environ",
+			hookRunner: &defaultHookRunner{},
+			hook: &Hook{
+				Run: `echo "$FOO"; echo err >&2`,
+			},
+			environ:    []string{"FOO=bar"},
+			wantOutput: "bar\nerr\n",
+		},
+		{
+			name:       "invalid-timeout",
+			hookRunner: &defaultHookRunner{},
+			hook: &Hook{
+				Run:     "true",
+				Timeout: "soon",
+			},
+			err: &klib.Error{
+				ID:     "f36bd6d3-073c-4d75-b613-9fc9d0e40d79",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+		{
+			name: "timeout",
+			hookRunner: &defaultHookRunner{
+				timeout: 10 * time.Millisecond,
+			},
+			hook: &Hook{
+				Run: "exec sleep 5",
+			},
+			err: &klib.Error{
+				ID:     "6041f4ed-30cc-441b-a1d0-85501ed206f3",
+				Status: http.StatusGatewayTimeout,
+				Code:   klib.CodeExecutionError,
+			},
+		},
+		{
+			name:       "failure",
+			hookRunner: &defaultHookRunner{},
+			hook: &Hook{
+				Run: "exit 3",
+			},
+			err: &klib.Error{
+				ID:     "a9253731-abb5-4ccf-b99d-d5bca9a2d286",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeExecutionError,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			buf := new(bytes.Buffer)
+			tc.hookRunner.w = buf
+
+			err := tc.hookRunner.Run(tc.hook, st.TempDir(), tc.environ)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantOutput, buf.String(), "Output mismatch")
+		})
+	}
+}
@@ -5,15 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/rs/zerolog/log"
 	"go.katupy.io/klib"
-	"gopkg.in/yaml.v3"
 
 	"go.katupy.io/xpdt/conf"
 )
@@ -25,8 +24,21 @@ type Loader struct {
 	container *container
 	platform  string
 
-	templateHandler klib.StringHandler
+	templateHandler TemplateHandler
 	fileLoader      FileLoader
+	commandMethods  *defaultCommandMethods
+	hookRunner      HookRunner
+	secretResolver  SecretResolver
+
+	// The key of encrypted data files and values.
+	keys *keySource
+
+	// Files of the chain, from the root file, the files that
+	// were not part of the previously loaded chain,
+	// and the files of the previous chain that are not part of it anymore.
+	chain  []*chainFile
+	joined map[*File]bool
+	left   []*chainFile
 }
 
 func NewLoader(config *conf.Config) *Loader {
@@ -90,59 +102,140 @@ func (l *Loader) Load() error {
 		caseInsensitiveEnvironment: l.config.CaseInsensitiveEnvironment,
 	}
 
+	switch l.config.Env.Load.ReverseStore {
+	case "", ReverseStoreEnv:
+	case ReverseStoreFile:
+		dir, err := stateDir()
+		if err != nil {
+			return klib.ForwardError("2f1090f3-a29d-41a3-8327-0726c7100936", err)
+		}
+
+		c.reverseDir = filepath.Join(dir, "reverse")
+	default:
+		return &klib.Error{
+			ID:     "e54f87ed-3132-446f-a668-3627d6a25666",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   ".env.load.reverseStore",
+			Detail: fmt.Sprintf("Invalid reverse store %q, must be one of %s or %s.", l.config.Env.Load.ReverseStore, ReverseStoreEnv, ReverseStoreFile),
+		}
+	}
+
+	switch l.config.Env.Load.Drift {
+	case "":
+		c.drift = DriftReconcile
+	case DriftReconcile, DriftPreserve, DriftReverse:
+		c.drift = l.config.Env.Load.Drift
+	default:
+		return &klib.Error{
+			ID:     "ee52e7ad-45a1-4713-b6b4-5816de024353",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   ".env.load.drift",
+			Detail: fmt.Sprintf("Invalid drift %q, must be one of %s, %s or %s.", l.config.Env.Load.Drift, DriftReconcile, DriftPreserve, DriftReverse),
+		}
+	}
+
+	// Secret values are recorded in the reverse by their HMAC with a key
+	// of the session, and are not recorded if there is no session state.
+	if dir, err := stateDir(); err == nil {
+		c.sumKeyPath = filepath.Join(dir, "session.key")
+	}
+
 	l.container = c
 
 	if err := c.loadEnviron(l.config.Env.Load.Environ); err != nil {
 		return klib.ForwardError("860fd303-8d01-45ac-9cce-9c901ec7d05d", err)
 	}
 
+	previousChain, err := c.readChain()
+	if err != nil {
+		return klib.ForwardError("0b46268e-04ec-45fc-bfe3-d558442820a2", err)
+	}
+
 	if err := c.applyReverse(); err != nil {
 		return klib.ForwardError("e19c02fa-1e38-45b5-b520-ece8edcb621b", err)
 	}
 
+	l.genChain(previousChain)
+
 	pathHandler := &defaultPathHandler{
 		caseSensitiveFilesystem: l.config.CaseSensitiveFilesystem,
+		resolveSymlinks:         l.config.Env.Load.ResolveSymlinks,
 	}
 
 	pathLoader := &defaultPathLoader{
 		pathHandler: pathHandler,
+		prune:       l.config.Env.Load.Prune,
+	}
+
+	if err := l.genTemplateHandler(l.data); err != nil {
+		return klib.ForwardError("5b7f745f-c637-41d9-a567-4a26c7433d1f", err)
+	}
+
+	if l.secretResolver == nil && l.config.Secrets != nil {
+		secretResolver, err := newSecretResolver(l.config.Secrets)
+		if err != nil {
+			return klib.ForwardError("f47e8654-3b73-42d6-9d92-2836137cae20", err)
+		}
+
+		l.secretResolver = secretResolver
 	}
 
-	l.genTemplateHandler(l.data)
+	l.commandMethods = &defaultCommandMethods{
+		container:       c,
+		pathHandler:     pathHandler,
+		pathLoader:      pathLoader,
+		templateHandler: l.templateHandler,
+		secretResolver:  l.secretResolver,
+		keys:            l.keySource(),
+	}
 
 	l.fileLoader = &defaultFileLoader{
+		platform: l.platform,
 		commandLoader: &defaultCommandLoader{
-			platform: l.platform,
-			commandMethods: &defaultCommandMethods{
-				container:       c,
-				pathHandler:     pathHandler,
-				pathLoader:      pathLoader,
-				templateHandler: l.templateHandler,
-			},
+			platform:       l.platform,
+			commandMethods: l.commandMethods,
 		},
 	}
 
 	for i := len(l.files) - 1; i >= 0; i-- {
 		file := l.files[i]
+		l.useFileData(file)
 
 		if err := l.fileLoader.Load(file); err != nil {
 			return klib.ForwardError("2fbe24dd-bc10-403f-b777-f3dd7898c8f4", err)
 		}
 	}
 
+	if err := l.loadShellDefs(); err != nil {
+		return klib.ForwardError("978c8954-76ec-4d18-bb75-324582450472", err)
+	}
+
+	if err := c.writeChain(l.chain); err != nil {
+		return klib.ForwardError("33fa244e-1b32-4437-a4b7-81a5c9773532", err)
+	}
+
 	c.makeDiff()
 
 	if err := c.writeDiff(l.config.Outw); err != nil {
 		return klib.ForwardError("35c11746-07ad-4bf0-86f9-a811a7e57aff", err)
 	}
 
+	l.writeNotices()
+
+	if err := l.runHooks(); err != nil {
+		return klib.ForwardError("c585468f-618d-498e-818b-afba41cc3985", err)
+	}
+
 	logDuration()
 
 	return nil
 }
 
 // FindFiles register the slice of files to be loaded, starting from the current directory
-// and going up the directory tree until a root directory is reached.
+// and going up the directory tree until a root directory is reached,
+// followed by the user-global files.
 func (l *Loader) FindFiles() error {
 	loadDir := strings.TrimSpace(l.config.Env.Load.Dir)
 
@@ -155,139 +248,67 @@ func (l *Loader) FindFiles() error {
 		return fmt.Errorf("failed to get abs path of c.Env.Load.Dir: %w", err)
 	}
 
-	loadFilename := strings.TrimSpace(l.config.Env.Load.Filename)
+	loadFilenames := conf.DefaultEnvLoadFilenames
 
-	if loadFilename == "" {
-		loadFilename = conf.DefaultEnvLoadFilename
+	if loadFilename := strings.TrimSpace(l.config.Env.Load.Filename); loadFilename != "" {
+		loadFilenames = []string{loadFilename}
 	}
 
 	l.platform = runtime.GOOS + "_" + runtime.GOARCH
 	l.data = map[string]any{
 		"_PLATFORM": l.platform,
+		"_OS":       runtime.GOOS,
+		"_ARCH":     runtime.GOARCH,
+		"_HOSTNAME": hostname(),
+		"_USER":     username(),
+		"_LOAD_DIR": dir,
 	}
 
 	for k := range l.config.Env.Data {
 		dataKey := k
 		dataFile := l.config.Env.Data[k]
 
-		b, err := os.ReadFile(dataFile)
+		values, err := readDataFile(dataFile, fmt.Sprintf(".env.data[%s]", dataKey), l.keySource())
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return &klib.Error{
-					ID:     "145a329c-9fe2-493a-ac6f-e70603dae4ec",
-					Status: http.StatusBadRequest,
-					Code:   klib.CodeNotFound,
-					Path:   fmt.Sprintf(".env.data[%s]", dataKey),
-					Title:  "File not found",
-					Cause:  err.Error(),
-					Meta: map[string]any{
-						"filepath": dataFile,
-					},
-				}
-			}
-
-			return &klib.Error{
-				ID:     "96dbb73e-d7e4-4c65-aa2e-81ab2d8bf588",
-				Status: http.StatusInternalServerError,
-				Code:   klib.CodeFileError,
-				Path:   fmt.Sprintf(".env.data[%s]", dataKey),
-				Title:  "Failed to read file",
-				Cause:  err.Error(),
-				Meta: map[string]any{
-					"filepath": dataFile,
-				},
-			}
-		}
-
-		ext := strings.ToLower(filepath.Ext(dataFile))
-		values := make(map[string]any)
-
-		switch ext {
-		case ".toml":
-			if err := toml.Unmarshal(b, &values); err != nil {
-				return &klib.Error{
-					ID:     "5705aeef-f9bb-45c8-815c-b8ca07bcaeda",
-					Status: http.StatusBadRequest,
-					Code:   klib.CodeSerializationError,
-					Path:   fmt.Sprintf(".env.data[%s]", dataKey),
-					Title:  "Failed to unmarshal toml file",
-					Cause:  err.Error(),
-				}
-			}
-		case ".yaml":
-			if err := yaml.Unmarshal(b, &values); err != nil {
-				return &klib.Error{
-					ID:     "c86e9b6f-a41c-4656-855e-7c6f6723efdd",
-					Status: http.StatusBadRequest,
-					Code:   klib.CodeSerializationError,
-					Path:   fmt.Sprintf(".env.data[%s]", dataKey),
-					Title:  "Failed to unmarshal yaml file",
-					Cause:  err.Error(),
-				}
-			}
+			return klib.ForwardError("955526dd-9bf3-4cb5-aa1d-0afdd1e69c9a", err)
 		}
 
 		l.data[k] = values
 	}
 
 	// There might be multiple overwrites for the same directory.
-	globalOverwrites := make(map[string][]*conf.EnvOverwrite, len(l.config.Env.Overwrites))
-
-	for i := range l.config.Env.Overwrites {
-		overwrite := l.config.Env.Overwrites[i]
-		overwriteDir := strings.TrimSpace(overwrite.Dir)
-
-		if overwriteDir == "" {
-			return &klib.Error{
-				ID:     "dc558b94-ddf9-4280-8eab-94e16cc79418",
-				Status: http.StatusBadRequest,
-				Code:   klib.CodeMissingValue,
-				Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
-				Detail: "Overwrite dir cannot be empty.",
-				Meta: map[string]any{
-					"#i":  i,
-					"dir": overwrite.Dir,
-				},
-			}
-		}
-
-		cleanDir := filepath.Clean(overwrite.Dir)
-
-		if !filepath.IsAbs(cleanDir) {
-			return &klib.Error{
-				ID:     "8ee66ad2-84e7-4aa1-8151-55af5c6f4b7d",
-				Status: http.StatusBadRequest,
-				Code:   klib.CodeInvalidValue,
-				Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
-				Detail: "Overwrite dir must be absolute.",
-				Meta: map[string]any{
-					"#i":  i,
-					"dir": overwrite.Dir,
-				},
-			}
-		}
-
-		globalOverwrites[cleanDir] = append(globalOverwrites[overwriteDir], overwrite)
+	overwriteMatchers, err := newOverwriteMatchers(l.config.Env.Overwrites, l.platform)
+	if err != nil {
+		return klib.ForwardError("3d346784-0f36-465b-8e7d-b01dae87fd02", err)
 	}
 
-	// addFile adds the file to the files slice and
+	// addFile adds the file applied to dir to the files slice and
 	// returns whether the file is a root file,
 	// indicating that file discovery should stop.
-	addFile := func(index int, overwrite *conf.EnvOverwrite) (bool, error) {
+	addFile := func(index int, overwrite *conf.EnvOverwrite, dir string) (bool, error) {
 		if overwrite.Skip {
+			log.Debug().
+				Str("_label", "envFileSkipped").
+				Str("dir", dir).
+				Str("reason", "overwrite skip").
+				Bool("root", overwrite.Root).
+				Send()
+
 			return overwrite.Root, nil
 		}
 
 		var path string
 
-		if overwrite.Dir != "" {
+		isOverwrite := overwrite.Dir != "" || overwrite.Remote != ""
+
+		if isOverwrite {
 			path = fmt.Sprintf(".env.overwrites[%d].file", index)
 		}
 
 		b, err := os.ReadFile(overwrite.File)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				if overwrite.Dir == "" {
+				if !isOverwrite {
 					// Move forward if the loader is not an overwrite.
 					return false, nil
 				}
@@ -318,37 +339,16 @@ func (l *Loader) FindFiles() error {
 			}
 		}
 
-		ext := strings.ToLower(filepath.Ext(overwrite.File))
-		file := new(File)
-
-		switch ext {
-		case ".toml":
-			if err := toml.Unmarshal(b, file); err != nil {
-				return false, &klib.Error{
-					ID:     "eaac6f84-4e1c-44de-a059-6821006d976a",
-					Status: http.StatusBadRequest,
-					Code:   klib.CodeSerializationError,
-					Path:   path,
-					Title:  "Failed to unmarshal toml file",
-					Cause:  err.Error(),
-				}
-			}
-		case ".yaml":
-			if err := yaml.Unmarshal(b, file); err != nil {
-				return false, &klib.Error{
-					ID:     "f7476e4b-e592-4f2c-ab97-cae327b957a4",
-					Status: http.StatusBadRequest,
-					Code:   klib.CodeSerializationError,
-					Path:   path,
-					Title:  "Failed to unmarshal yaml file",
-					Cause:  err.Error(),
-				}
-			}
+		file, err := decodeFile(b, overwrite.File, path)
+		if err != nil {
+			return false, klib.ForwardError("6b12bd50-53bd-4fbb-b48f-3bb79d23ebfd", err)
 		}
 
-		file.filepath = overwrite.File
 		file.dir = dir
 
+		// Overwrite files are configured by the user.
+		file.trusted = isOverwrite
+
 		if overwrite.Root {
 			file.Root = true
 		}
@@ -383,28 +383,50 @@ func (l *Loader) FindFiles() error {
 		return file.Root, nil
 	}
 
+	stop, err := l.discoveryCeiling()
+	if err != nil {
+		return klib.ForwardError("e78e5ac5-6b71-417f-b824-31047055f23c", err)
+	}
+
 GET_FILES_LOOP:
 	for {
 		// First check if there are global overwrites for this directory.
-		overwrites, ok := globalOverwrites[dir]
+		overwrites, err := overwriteMatchers.match(dir)
+		if err != nil {
+			return klib.ForwardError("f05f4856-75d5-4f6c-b3b4-97aef384405d", err)
+		}
+
+		ok := len(overwrites) > 0
 
 		if !ok {
-			overwrites = []*conf.EnvOverwrite{{
-				File: filepath.Join(dir, loadFilename),
-			}}
+			overwrites, err = findDirFiles(dir, loadFilenames)
+			if err != nil {
+				return klib.ForwardError("0c1c4e37-fd02-465c-93ec-0a029a3acf83", err)
+			}
 		}
 
+		root := false
+
 		for i := range overwrites {
-			root, err := addFile(i, overwrites[i])
+			fileRoot, err := addFile(i, overwrites[i], dir)
 			if err != nil {
 				return err
 			}
 
-			if root {
-				break GET_FILES_LOOP
+			if fileRoot {
+				if ok {
+					break GET_FILES_LOOP
+				}
+
+				// The local file of a root directory still applies.
+				root = true
 			}
 		}
 
+		if root {
+			break
+		}
+
 		parentDir := filepath.Join(dir, "../")
 
 		if parentDir == dir {
@@ -412,14 +434,545 @@ GET_FILES_LOOP:
 			break
 		}
 
+		if reason := stop(dir, parentDir); reason != "" {
+			log.Debug().
+				Str("_label", "envDiscoveryStopped").
+				Str("dir", dir).
+				Str("reason", reason).
+				Send()
+
+			break
+		}
+
 		dir = parentDir
 	}
 
+	// The dir of the root file, or of the topmost file if there is no root file,
+	// which is the load dir if no files were found.
+	l.data["_ROOT_DIR"] = l.data["_LOAD_DIR"]
+
+	if len(l.files) > 0 {
+		l.data["_ROOT_DIR"] = l.files[len(l.files)-1].dir
+	}
+
+	if !l.config.Env.Load.NoGlobal {
+		if err := l.addGlobalFiles(addFile); err != nil {
+			return klib.ForwardError("b02a2a0e-fd79-4146-8aaf-2b2a8299eeb7", err)
+		}
+	}
+
+	if err := l.trustFiles(); err != nil {
+		return klib.ForwardError("42eb6ee4-2b56-48fe-86f4-ed5f7fd528a1", err)
+	}
+
+	if err := l.loadFileData(); err != nil {
+		return klib.ForwardError("d9fd2946-491f-4d11-8d5a-55ff4b4bb4e1", err)
+	}
+
+	return nil
+}
+
+// trustFiles marks which files have unrestricted templates,
+// hooks and shell definitions, according to the sandbox policy and the trusted dirs.
+func (l *Loader) trustFiles() error {
+	trust, err := l.fileTrust()
+	if err != nil {
+		return klib.ForwardError("841e0264-556f-4361-a5c3-3e1ab523e7fc", err)
+	}
+
+	for _, file := range l.files {
+		file.trusted = trust(file.dir, file.trusted)
+
+		log.Debug().
+			Str("_label", "envFileTrust").
+			Str("filepath", file.filepath).
+			Bool("trusted", file.trusted).
+			Send()
+	}
+
+	return nil
+}
+
+// fileTrust returns whether a file of dir is trusted, given whether
+// the file is configured by the user, i.e. an overwrite or global file.
+func (l *Loader) fileTrust() (func(dir string, configured bool) bool, error) {
+	switch l.config.Env.Load.Sandbox {
+	case "", SandboxUntrusted:
+	case SandboxAll:
+		return func(string, bool) bool { return false }, nil
+	case SandboxOff:
+		return func(string, bool) bool { return true }, nil
+	default:
+		return nil, &klib.Error{
+			ID:     "c53ca155-80f8-46a9-911c-193741e84cbe",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   ".env.load.sandbox",
+			Detail: fmt.Sprintf("Invalid sandbox %q, must be one of %s, %s or %s.", l.config.Env.Load.Sandbox, SandboxUntrusted, SandboxAll, SandboxOff),
+		}
+	}
+
+	trustedDirs := make([]string, 0, len(l.config.Env.Load.TrustedDirs))
+
+	for i, trustedDir := range l.config.Env.Load.TrustedDirs {
+		dir, err := expandTilde(strings.TrimSpace(trustedDir))
+		if err != nil {
+			return nil, klib.ForwardError("bad835d0-eaa9-48d2-b320-a97246703ae3", err)
+		}
+
+		if !filepath.IsAbs(dir) {
+			return nil, &klib.Error{
+				ID:     "557faae1-17f3-4b97-9bd2-c2408aea735a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   fmt.Sprintf(".env.load.trustedDirs[%d]", i),
+				Detail: "Trusted dir must be absolute.",
+				Meta: map[string]any{
+					"#i":  i,
+					"dir": trustedDir,
+				},
+			}
+		}
+
+		trustedDirs = append(trustedDirs, filepath.Clean(dir))
+	}
+
+	return func(fileDir string, configured bool) bool {
+		if configured {
+			return true
+		}
+
+		for _, dir := range trustedDirs {
+			rel, err := filepath.Rel(dir, fileDir)
+
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// addGlobalFiles adds the user-global files with addFile,
+// to be applied beneath the discovered chain.
+func (l *Loader) addGlobalFiles(addFile func(index int, overwrite *conf.EnvOverwrite, dir string) (bool, error)) error {
+	globalDir := globalEnvDir()
+
+	if globalDir == "" {
+		return nil
+	}
+
+	globalFiles, err := findDirFiles(globalDir, conf.DefaultEnvGlobalFilenames)
+	if err != nil {
+		return klib.ForwardError("959243c3-6d37-4abf-a114-650ab635b3df", err)
+	}
+
+	filesLen := len(l.files)
+
+	for i := range globalFiles {
+		if _, err := addFile(i, globalFiles[i], globalDir); err != nil {
+			return klib.ForwardError("0e6b1f1c-eb2f-44b3-a6b8-9628a02493ed", err)
+		}
+	}
+
+	// Global files are configured by the user.
+	for _, file := range l.files[filesLen:] {
+		file.trusted = true
+	}
+
 	return nil
 }
 
+// loadFileData loads the template data of each file, from the root file,
+// so that the data of a file is merged over the data of its parents.
+func (l *Loader) loadFileData() error {
+	data := l.data
+
+	for i := len(l.files) - 1; i >= 0; i-- {
+		file := l.files[i]
+
+		if len(file.Data) > 0 || len(file.DataFiles) > 0 {
+			merged := make(map[string]any, len(data)+len(file.Data)+len(file.DataFiles))
+
+			for k, v := range data {
+				merged[k] = v
+			}
+
+			for k, v := range file.Data {
+				merged[k] = v
+			}
+
+			for k, dataFile := range file.DataFiles {
+				if !filepath.IsAbs(dataFile) {
+					dataFile = filepath.Join(filepath.Dir(file.filepath), dataFile)
+				}
+
+				// Untrusted files could decrypt any file encrypted with the key.
+				if !file.trusted && strings.EqualFold(filepath.Ext(dataFile), EncryptedExt) {
+					return &klib.Error{
+						ID:     "a9504206-3277-4d41-a8fe-272e21d4f2d4",
+						Status: http.StatusForbidden,
+						Code:   klib.CodeInvalidValue,
+						Path:   fmt.Sprintf(".dataFiles[%s]", k),
+						Detail: fmt.Sprintf("Encrypted data files are not allowed in untrusted files, trust the dir of %s to allow them.", file.filepath),
+						Meta: map[string]any{
+							"filepath": dataFile,
+						},
+					}
+				}
+
+				values, err := readDataFile(dataFile, fmt.Sprintf(".dataFiles[%s]", k), l.keySource())
+				if err != nil {
+					return klib.ForwardError("143acbeb-6371-45fb-bf18-cffcf0eaa864", err)
+				}
+
+				merged[k] = values
+			}
+
+			data = merged
+		}
+
+		file.data = make(map[string]any, len(data)+2)
+
+		for k, v := range data {
+			file.data[k] = v
+		}
+
+		file.data["_DIR"] = file.dir
+		file.data["_FILE"] = file.filepath
+	}
+
+	return nil
+}
+
+// hostname returns the hostname, or an empty string if it is unknown.
+// It is only used for template data, overwrites fail if it is unknown.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		log.Debug().
+			Str("_label", "hostnameUnknown").
+			Err(err).
+			Send()
+
+		return ""
+	}
+
+	return name
+}
+
+// username returns the name of the current user,
+// or of $USER if the user cannot be looked up.
+// It is only used for template data, overwrites fail if it is unknown.
+func username() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Debug().
+			Str("_label", "usernameUnknown").
+			Err(err).
+			Send()
+
+		return os.Getenv("USER")
+	}
+
+	return u.Username
+}
+
+// keySource returns the key of encrypted data files and values,
+// which is only loaded if they are used.
+func (l *Loader) keySource() *keySource {
+	if l.keys == nil {
+		var secrets *conf.Secrets
+
+		if l.config != nil {
+			secrets = l.config.Secrets
+		}
+
+		l.keys = newKeySource(secrets)
+	}
+
+	return l.keys
+}
+
+// useFileData makes the template handler use the data of file,
+// restricting its templates if file is not trusted.
+func (l *Loader) useFileData(file *File) {
+	l.templateHandler.UseFile(file.data, !file.trusted, sandboxDir(file.dir))
+}
+
+// sandboxDir returns the dir the templates of an untrusted file of dir
+// are confined to, which is its git root, or dir itself if it is not
+// in a git repository or the repository is the home dir, e.g. of dotfiles.
+// Parent files are not part of the sandbox, since the topmost one is often
+// in the home dir.
+func sandboxDir(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	gitRoot := findGitRoot(dir)
+
+	if gitRoot == "" {
+		return dir
+	}
+
+	if homeDir, err := os.UserHomeDir(); err == nil && filepath.Clean(homeDir) == gitRoot {
+		return dir
+	}
+
+	return gitRoot
+}
+
+// globalEnvDir returns the directory of the user-global env files,
+// or an empty string if there is no user config directory.
+func globalEnvDir() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+
+	if !filepath.IsAbs(configDir) {
+		var err error
+
+		configDir, err = os.UserConfigDir()
+		if err != nil {
+			log.Debug().
+				Str("_label", "globalEnvDirSkipped").
+				Err(err).
+				Send()
+
+			return ""
+		}
+	}
+
+	return filepath.Join(configDir, "xpdt")
+}
+
+// discoveryCeiling returns a function that tells why the discovery of env files
+// should not move from dir to parentDir, or an empty string if it should.
+func (l *Loader) discoveryCeiling() (func(dir, parentDir string) string, error) {
+	var home string
+
+	if l.config.Env.Load.StopAtHome {
+		var err error
+
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "5f594cc6-cbad-45f4-bdb0-33ce7a0b7fee",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeFilesystemError,
+				Path:   ".env.load.stopAtHome",
+				Title:  "Failed to get home directory",
+				Cause:  err.Error(),
+			}
+		}
+
+		home = filepath.Clean(home)
+	}
+
+	ceilingDirs := make(map[string]bool)
+
+	addCeilingDirs := func(dirs []string, path string) error {
+		for i := range dirs {
+			ceilingDir := strings.TrimSpace(dirs[i])
+
+			if ceilingDir == "" {
+				continue
+			}
+
+			ceilingDir, err := expandTilde(ceilingDir)
+			if err != nil {
+				return klib.ForwardError("8f9bb184-2ae2-4dcd-96b5-b0d489d21c54", err)
+			}
+
+			if !filepath.IsAbs(ceilingDir) {
+				return &klib.Error{
+					ID:     "92453840-2269-466b-a91e-e755533ebae4",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeInvalidValue,
+					Path:   fmt.Sprintf("%s[%d]", path, i),
+					Detail: "Ceiling dir must be absolute.",
+					Meta: map[string]any{
+						"dir": dirs[i],
+					},
+				}
+			}
+
+			ceilingDirs[filepath.Clean(ceilingDir)] = true
+		}
+
+		return nil
+	}
+
+	if err := addCeilingDirs(l.config.Env.Load.CeilingDirs, ".env.load.ceilingDirs"); err != nil {
+		return nil, klib.ForwardError("bf4f9b83-74fb-4da6-b616-50a0ec7ac8f7", err)
+	}
+
+	envCeilingDirs := filepath.SplitList(os.Getenv(conf.EnvCeilingDirsVar))
+
+	if err := addCeilingDirs(envCeilingDirs, "$"+conf.EnvCeilingDirsVar); err != nil {
+		return nil, klib.ForwardError("ee8616a2-1055-40fe-8be2-a49c8b005109", err)
+	}
+
+	stop := func(dir, parentDir string) string {
+		if l.config.Env.Load.StopAtGitRoot {
+			if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+				return "gitRoot"
+			}
+		}
+
+		if home != "" && dir == home {
+			return "home"
+		}
+
+		if ceilingDirs[parentDir] {
+			return "ceilingDir"
+		}
+
+		return ""
+	}
+
+	return stop, nil
+}
+
+// findDirFiles returns the shared env file of dir, followed by the fragments
+// of its fragment directory, in lexical order, and by its local env file,
+// which is applied last. The shared and local env files are looked up
+// by the given filenames, and it is an error if more than one of them exists.
+func findDirFiles(dir string, filenames []string) ([]*conf.EnvOverwrite, error) {
+	var files []*conf.EnvOverwrite
+
+	lookup := func(local bool) error {
+		var found string
+
+		for _, filename := range filenames {
+			if local {
+				filename = localFilename(filename)
+			}
+
+			path := filepath.Join(dir, filename)
+
+			if _, err := os.Stat(path); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+
+				return &klib.Error{
+					ID:     "31fd7154-6c42-4b2f-aa85-b4efb3127c32",
+					Status: http.StatusInternalServerError,
+					Code:   klib.CodeFilesystemError,
+					Title:  "Failed to stat file",
+					Cause:  err.Error(),
+					Meta: map[string]any{
+						"filepath": path,
+					},
+				}
+			}
+
+			if found != "" {
+				return &klib.Error{
+					ID:     "7fcfa7de-5850-4001-99d4-c1c75f442f43",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeInvalidValue,
+					Detail: fmt.Sprintf("Only one env file is allowed per directory, found %s and %s.", filepath.Base(found), filename),
+					Meta: map[string]any{
+						"dir": dir,
+					},
+				}
+			}
+
+			found = path
+		}
+
+		if found != "" {
+			files = append(files, &conf.EnvOverwrite{
+				File: found,
+			})
+		}
+
+		return nil
+	}
+
+	if err := lookup(false); err != nil {
+		return nil, klib.ForwardError("5e09cb3b-7202-43ee-8b9b-35f72909a271", err)
+	}
+
+	fragmentDir := filepath.Join(dir, fragmentDirname(filenames[0]))
+
+	// ReadDir returns the entries sorted by filename.
+	entries, err := os.ReadDir(fragmentDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, &klib.Error{
+			ID:     "17909ed6-fd5f-4ce2-947c-5c6a4ce0949d",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFilesystemError,
+			Title:  "Failed to read directory",
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"dir": fragmentDir,
+			},
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".toml", ".yaml", ".yml", ".json":
+			files = append(files, &conf.EnvOverwrite{
+				File: filepath.Join(fragmentDir, entry.Name()),
+			})
+		}
+	}
+
+	if err := lookup(true); err != nil {
+		return nil, klib.ForwardError("a44ef38f-c364-48fd-873d-2f394e7d8d46", err)
+	}
+
+	return files, nil
+}
+
+// fragmentDirname returns the name of the fragment directory
+// of an env filename, e.g. .xpdt.d for .xpdt.toml.
+func fragmentDirname(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".d"
+}
+
+// localFilename returns the personal counterpart of an env filename,
+// e.g. .xpdt.local.toml for .xpdt.toml.
+func localFilename(filename string) string {
+	ext := filepath.Ext(filename)
+
+	return strings.TrimSuffix(filename, ext) + ".local" + ext
+}
+
 // genTemplateHandler generates a template handler for the given data.
-func (l *Loader) genTemplateHandler(data map[string]any) {
+func (l *Loader) genTemplateHandler(data map[string]any) error {
+	timeout := DefaultTemplateTimeout
+
+	if l.config.Env.Load.TemplateTimeout != "" {
+		d, err := time.ParseDuration(l.config.Env.Load.TemplateTimeout)
+		if err != nil {
+			return &klib.Error{
+				ID:     "6af798b8-84dc-4fa0-a6e6-1bb94b543033",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.load.templateTimeout",
+				Detail: fmt.Sprintf("Invalid template timeout %q.", l.config.Env.Load.TemplateTimeout),
+				Cause:  err.Error(),
+			}
+		}
+
+		timeout = d
+	}
+
+	maxOutput := l.config.Env.Load.TemplateMaxOutput
+
+	if maxOutput <= 0 {
+		maxOutput = DefaultTemplateMaxOutput
+	}
+
 	funcMap := klib.BaseFuncMap()
 
 	getEnv := func(k string) string {
@@ -434,6 +987,11 @@ func (l *Loader) genTemplateHandler(data map[string]any) {
 			return ""
 		}
 
+		// The current value of path lists is only set when the diff is made.
+		if envVar.pathList {
+			return strings.Join(envVar.pathListElements, string(os.PathListSeparator))
+		}
+
 		return envVar.currentValue
 	}
 
@@ -441,12 +999,355 @@ func (l *Loader) genTemplateHandler(data map[string]any) {
 		return os.Expand(s, getEnv)
 	}
 
+	// origEnv returns the value of k before this load.
+	origEnv := func(k string) string {
+		keyName := k
+
+		if l.container.caseInsensitiveEnvironment {
+			keyName = strings.ToUpper(keyName)
+		}
+
+		envVar, haveVar := l.container.env[keyName]
+		if !haveVar {
+			return ""
+		}
+
+		return envVar.originalValue
+	}
+
 	// Replace sprig's env and expandenv with our own.
 	funcMap["env"] = getEnv
 	funcMap["expandenv"] = expandEnv
+	funcMap["origEnv"] = origEnv
+
+	funcMap["readFile"] = readFile
+	funcMap["fileExists"] = fileExists
+	funcMap["dirExists"] = dirExists
+	funcMap["glob"] = filepath.Glob
+	funcMap["findUp"] = findUp
+	funcMap["gitRoot"] = currentGitRoot
+	funcMap["gitBranch"] = currentGitBranch
+	funcMap["abs"] = filepath.Abs
+	funcMap["rel"] = filepath.Rel
+	funcMap["which"] = func(name string) string {
+		return lookPath(name, getEnv("PATH"))
+	}
 
 	l.templateHandler = &templateHandler{
-		data:    data,
-		funcMap: funcMap,
+		data:      data,
+		funcMap:   funcMap,
+		timeout:   timeout,
+		maxOutput: maxOutput,
+	}
+
+	return nil
+}
+
+// genChain generates the chain of files to be loaded,
+// and which files joined or left it since the previous chain.
+func (l *Loader) genChain(previousChain []*chainFile) {
+	previous := make(map[string]bool, len(previousChain))
+
+	for i := range previousChain {
+		previous[previousChain[i].Key] = true
+	}
+
+	l.chain = make([]*chainFile, 0, len(l.files))
+	l.joined = make(map[*File]bool, len(l.files))
+	current := make(map[string]bool, len(l.files))
+
+	for i := len(l.files) - 1; i >= 0; i-- {
+		file := l.files[i]
+		key := file.chainKey()
+
+		l.chain = append(l.chain, &chainFile{
+			Key: key,
+			Dir: file.dir,
+		})
+
+		current[key] = true
+
+		if !previous[key] {
+			l.joined[file] = true
+		}
+	}
+
+	l.left = nil
+
+	for i := range previousChain {
+		if !current[previousChain[i].Key] {
+			l.left = append(l.left, previousChain[i])
+		}
+	}
+}
+
+// runHooks runs the leave hooks of the files that left the chain,
+// starting from the deepest file, and then the enter hooks of the
+// files that joined the chain, starting from the root file.
+// Hook failures are reported, but do not fail the load,
+// since the environment has already been written.
+func (l *Loader) runHooks() error {
+	if l.hookRunner == nil {
+		timeout := DefaultHookTimeout
+
+		if l.config.Env.Load.HookTimeout != "" {
+			d, err := time.ParseDuration(l.config.Env.Load.HookTimeout)
+			if err != nil {
+				return &klib.Error{
+					ID:     "5016fd44-8965-47cc-8fbb-aae2d715ecbd",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeInvalidValue,
+					Path:   ".env.load.hookTimeout",
+					Detail: fmt.Sprintf("Invalid hook timeout %q.", l.config.Env.Load.HookTimeout),
+					Cause:  err.Error(),
+				}
+			}
+
+			timeout = d
+		}
+
+		l.hookRunner = &defaultHookRunner{
+			platform: l.platform,
+			timeout:  timeout,
+			w:        l.config.Logw,
+		}
+	}
+
+	run := func(hooks []*Hook, dir string, environ []string) {
+		for i := range hooks {
+			if err := l.hookRunner.Run(hooks[i], dir, environ); err != nil {
+				fmt.Fprintf(l.config.Logw, "xpdt: warning: %s\n", err)
+			}
+		}
+	}
+
+	for i := len(l.left) - 1; i >= 0; i-- {
+		file := l.leftFile(l.left[i])
+		if file == nil || len(file.OnLeave) == 0 {
+			continue
+		}
+
+		if !file.trusted {
+			log.Warn().
+				Str("_label", "hooksSkipped").
+				Str("filepath", file.filepath).
+				Str("reason", "untrusted").
+				Send()
+
+			continue
+		}
+
+		run(file.OnLeave, file.dir, l.config.Env.Load.Environ)
+	}
+
+	var environ []string
+
+	for i := len(l.files) - 1; i >= 0; i-- {
+		file := l.files[i]
+
+		if !l.joined[file] || len(file.OnEnter) == 0 {
+			continue
+		}
+
+		if !file.trusted {
+			log.Warn().
+				Str("_label", "hooksSkipped").
+				Str("filepath", file.filepath).
+				Str("reason", "untrusted").
+				Send()
+
+			continue
+		}
+
+		if environ == nil {
+			environ = l.container.environ()
+		}
+
+		run(file.OnEnter, file.dir, environ)
+	}
+
+	return nil
+}
+
+// leftFile reads the file of chainFile, which left the chain, for its leave hooks.
+// The hooks are never read from the chain env var, since it is inherited
+// from whatever started xpdt, so they are not run if the file is gone.
+func (l *Loader) leftFile(chainFile *chainFile) *File {
+	filename, ok := strings.CutPrefix(chainFile.Key, chainFile.Dir+string(os.PathListSeparator))
+	if !ok || filename == "" {
+		log.Debug().
+			Str("_label", "leaveHooksSkipped").
+			Str("key", chainFile.Key).
+			Str("reason", "invalid chain key").
+			Send()
+
+		return nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		log.Debug().
+			Str("_label", "leaveHooksSkipped").
+			Str("filepath", filename).
+			Err(err).
+			Send()
+
+		return nil
+	}
+
+	file, err := decodeFile(b, filename, "")
+	if err != nil {
+		log.Debug().
+			Str("_label", "leaveHooksSkipped").
+			Str("filepath", filename).
+			Err(err).
+			Send()
+
+		return nil
+	}
+
+	// The dir comes from the chain env var, so it is only used for files
+	// configured by the user, which apply to other dirs. Any other file
+	// applies to the dir it is in, which must be the recorded one.
+	configured := l.configuredFile(filename)
+
+	if !configured && filepath.Dir(filename) != filepath.Clean(chainFile.Dir) {
+		log.Debug().
+			Str("_label", "leaveHooksSkipped").
+			Str("filepath", filename).
+			Str("dir", chainFile.Dir).
+			Str("reason", "chain dir mismatch").
+			Send()
+
+		return nil
+	}
+
+	file.dir = chainFile.Dir
+
+	trust, err := l.fileTrust()
+	if err != nil {
+		log.Debug().
+			Str("_label", "leaveHooksSkipped").
+			Str("filepath", filename).
+			Err(err).
+			Send()
+
+		return nil
+	}
+
+	file.trusted = trust(file.dir, configured)
+
+	return file
+}
+
+// configuredFile returns whether filename is configured by the user,
+// i.e. it is the file of an overwrite or a global file.
+func (l *Loader) configuredFile(filename string) bool {
+	if globalDir := globalEnvDir(); globalDir != "" && filepath.Dir(filename) == globalDir {
+		return true
+	}
+
+	for _, overwrite := range l.config.Env.Overwrites {
+		if overwrite.File == filename {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadShellDefs defines the shell aliases and functions of the chain.
+// Definitions of deeper files take precedence over the ones of their parents.
+func (l *Loader) loadShellDefs() error {
+	shell := strings.ToLower(strings.TrimSpace(l.config.Env.Load.Shell))
+
+	if shell == "" {
+		// The shell would not understand the definitions,
+		// so keep the previous ones to be reversed later.
+		for _, state := range l.container.shellDefs {
+			state.currentValue = state.previousValue
+			state.current = state.previous
+		}
+
+		return nil
+	}
+
+	for i := len(l.files) - 1; i >= 0; i-- {
+		file := l.files[i]
+
+		if !file.trusted {
+			if len(file.Aliases) > 0 || len(file.Functions) > 0 {
+				log.Warn().
+					Str("_label", "shellDefsSkipped").
+					Str("filepath", file.filepath).
+					Str("reason", "untrusted").
+					Send()
+			}
+
+			continue
+		}
+
+		l.useFileData(file)
+
+		for _, group := range []struct {
+			kind string
+			path string
+			defs []*ShellDef
+		}{
+			{shellDefAlias, ".aliases", file.Aliases},
+			{shellDefFunction, ".functions", file.Functions},
+		} {
+			for j := range group.defs {
+				def := group.defs[j]
+
+				if def.Shell != "" && strings.ToLower(def.Shell) != shell {
+					continue
+				}
+
+				if def.Name == "" {
+					return &klib.Error{
+						ID:     "38e0321b-39dd-450c-8126-084982c7ae57",
+						Status: http.StatusBadRequest,
+						Code:   klib.CodeMissingValue,
+						Path:   fmt.Sprintf("%s[%d].name", group.path, j),
+						Detail: "Shell definition name cannot be empty.",
+						Meta: map[string]any{
+							"filepath": file.filepath,
+						},
+					}
+				}
+
+				value, err := l.templateHandler.Handle(def.Value)
+				if err != nil {
+					return klib.ForwardError("1776939e-d860-4f0b-8cf9-f795a2c0094e", err)
+				}
+
+				state := l.container.shellDef(group.kind, def.Name)
+				state.currentValue = value
+				state.current = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeNotices writes the notices of files that joined the chain.
+func (l *Loader) writeNotices() {
+	if l.config.Env.Load.NoNotices {
+		return
+	}
+
+	for _, n := range l.commandMethods.notices {
+		if !l.joined[n.file.chainMember()] {
+			continue
+		}
+
+		switch n.level {
+		case EchoLevelWarn:
+			fmt.Fprintf(l.config.Logw, "xpdt: warning: %s\n", n.message)
+		default:
+			fmt.Fprintf(l.config.Logw, "xpdt: %s\n", n.message)
+		}
 	}
 }
@@ -1,13 +1,18 @@
 package env
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"go.katupy.io/klib"
 	"go.katupy.io/klib/must"
 
@@ -16,9 +21,10 @@ import (
 
 func TestLoader_Load(t *testing.T) {
 	testCases := []*struct {
-		name   string
-		config *conf.Config
-		err    *klib.Error
+		name       string
+		config     *conf.Config
+		err        *klib.Error
+		wantOutput string
 	}{
 		{
 			name: "nil-config",
@@ -51,12 +57,36 @@ func TestLoader_Load(t *testing.T) {
 				Path:   ".env.load",
 			},
 		},
+		{
+			name: "env-in-untrusted-file",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:           must.FilepathAbs(filepath.Join("tests", "untrusted-env")),
+						NoGlobal:      true,
+						NoLogDuration: true,
+						Environ:       []string{"NAME=test", "HOME=/home/test"},
+					},
+				},
+			},
+			wantOutput: "SET\nGREETING\ntest at /home/test\n",
+		},
 	}
 
 	for i := range testCases {
 		tc := testCases[i]
 
 		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			outw := new(bytes.Buffer)
+
+			// Files are loaded from their dir.
+			chdir(st, ".")
+
+			if tc.config != nil {
+				tc.config.Outw = outw
+				tc.config.Logw = new(bytes.Buffer)
+			}
+
 			loader := &Loader{
 				config: tc.config,
 			}
@@ -65,16 +95,45 @@ func TestLoader_Load(t *testing.T) {
 			if klib.CheckTestError(st, err, tc.err) {
 				return
 			}
+
+			assert.Contains(st, outw.String(), tc.wantOutput, "Output mismatch")
 		})
 	}
 }
 
 func TestLoader_FindFiles(t *testing.T) {
+	// Ignore the user-global files of the environment.
+	t.Setenv("XDG_CONFIG_HOME", must.FilepathAbs(filepath.Join("tests", "no-global")))
+
+	ceilingsDir := func(elem ...string) string {
+		return must.FilepathAbs(filepath.Join(append([]string{"tests", "ceilings"}, elem...)...))
+	}
+
+	ceilingsFiles := func(dirs ...string) []*File {
+		files := make([]*File, 0, len(dirs))
+
+		for i := range dirs {
+			files = append(files, &File{
+				dir:      dirs[i],
+				filepath: filepath.Join(dirs[i], ".xpdt.toml"),
+			})
+		}
+
+		return files
+	}
+
 	testCases := []*struct {
 		name   string
+		setup  func(st *testing.T)
 		config *conf.Config
 		files  []*File
 		err    *klib.Error
+
+		// The expected _ROOT_DIR, if not empty.
+		rootDir string
+
+		// Whether each file is expected to be trusted, if not nil.
+		trusted []bool
 	}{
 		{
 			name: "empty-env-overwrite-dir",
@@ -151,6 +210,23 @@ func TestLoader_FindFiles(t *testing.T) {
 				Code:   klib.CodeSerializationError,
 			},
 		},
+		{
+			name: "unsupported-data-file",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{},
+					Data: map[string]string{
+						"values": filepath.Join("tests", "data", "values.txt"),
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "bfc8a1a2-dbbf-4da6-a4ad-89d059ca5054",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.data[values]",
+			},
+		},
 		{
 			name: "no-env-files",
 			config: &conf.Config{
@@ -160,6 +236,7 @@ func TestLoader_FindFiles(t *testing.T) {
 					},
 				},
 			},
+			rootDir: must.FilepathAbs("."),
 		},
 		{
 			name: "single-root-file",
@@ -173,15 +250,15 @@ func TestLoader_FindFiles(t *testing.T) {
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", "2")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", "2", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", "2", ".xpdt.yaml")),
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file", "1")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", ".xpdt.yaml")),
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
 				},
 			},
 		},
@@ -197,7 +274,7 @@ func TestLoader_FindFiles(t *testing.T) {
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "multiple-root-files", "1")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-root-files", "1", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-root-files", "1", ".xpdt.yaml")),
 				},
 			},
 		},
@@ -220,7 +297,7 @@ func TestLoader_FindFiles(t *testing.T) {
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "overwrite-root-file", "1", "2")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-root-file", "1", "2", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-root-file", "1", "2", ".xpdt.yaml")),
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "overwrite-root-file", "1")),
@@ -246,11 +323,11 @@ func TestLoader_FindFiles(t *testing.T) {
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "overwrite-skip", "1", "2")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-skip", "1", "2", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-skip", "1", "2", ".xpdt.yaml")),
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "overwrite-skip")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-skip", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "overwrite-skip", ".xpdt.yaml")),
 				},
 			},
 		},
@@ -280,7 +357,7 @@ func TestLoader_FindFiles(t *testing.T) {
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", "1", "2")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", "1", "2", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", "1", "2", ".xpdt.yaml")),
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", "1")),
@@ -296,7 +373,7 @@ func TestLoader_FindFiles(t *testing.T) {
 				},
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir")),
-					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", conf.DefaultEnvLoadFilename)),
+					filepath: must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-same-dir", ".xpdt.yaml")),
 				},
 			},
 		},
@@ -323,6 +400,7 @@ func TestLoader_FindFiles(t *testing.T) {
 					},
 				},
 			},
+			trusted: []bool{true, true},
 			files: []*File{
 				{
 					dir:      must.FilepathAbs(filepath.Join("tests", "multiple-overwrites-intermediate-root", "1")),
@@ -334,12 +412,322 @@ func TestLoader_FindFiles(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "local-file",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir: filepath.Join("tests", "local-file", "1"),
+					},
+				},
+			},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "local-file", "1")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "local-file", "1", ".xpdt.local.json")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "local-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "local-file", ".xpdt.local.yml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "local-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "local-file", ".xpdt.toml")),
+				},
+			},
+		},
+		{
+			name: "fragments",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir: filepath.Join("tests", "fragments", "1"),
+					},
+				},
+			},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "fragments", "1")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "fragments", "1", ".xpdt.d", "aws.toml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "fragments")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "fragments", ".xpdt.local.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "fragments")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "fragments", ".xpdt.d", "20-node.toml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "fragments")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "fragments", ".xpdt.d", "10-go.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "fragments")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "fragments", ".xpdt.yaml")),
+				},
+			},
+		},
+		{
+			name: "multiple-formats",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir: filepath.Join("tests", "multiple-formats"),
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "7fcfa7de-5850-4001-99d4-c1c75f442f43",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+			},
+		},
+		{
+			name: "stop-at-git-root",
+			setup: func(st *testing.T) {
+				gitDir := filepath.Join(ceilingsDir("1"), ".git")
+
+				if err := os.Mkdir(gitDir, 0o755); err != nil {
+					st.Fatal(err)
+				}
+
+				st.Cleanup(func() { os.Remove(gitDir) })
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:           ceilingsDir("1", "2"),
+						StopAtGitRoot: true,
+					},
+				},
+			},
+			files: ceilingsFiles(ceilingsDir("1", "2"), ceilingsDir("1")),
+		},
+		{
+			name: "stop-at-home",
+			setup: func(st *testing.T) {
+				st.Setenv("HOME", ceilingsDir("1"))
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:        ceilingsDir("1", "2"),
+						StopAtHome: true,
+					},
+				},
+			},
+			files: ceilingsFiles(ceilingsDir("1", "2"), ceilingsDir("1")),
+		},
+		{
+			name: "ceiling-dirs",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:         ceilingsDir("1", "2"),
+						CeilingDirs: []string{"", ceilingsDir("1")},
+					},
+				},
+			},
+			files: ceilingsFiles(ceilingsDir("1", "2")),
+		},
+		{
+			name: "ceiling-dirs-env",
+			setup: func(st *testing.T) {
+				st.Setenv(conf.EnvCeilingDirsVar, string(os.PathListSeparator)+ceilingsDir())
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir: ceilingsDir("1", "2"),
+					},
+				},
+			},
+			files: ceilingsFiles(ceilingsDir("1", "2"), ceilingsDir("1")),
+		},
+		{
+			name: "global-files",
+			setup: func(st *testing.T) {
+				st.Setenv("XDG_CONFIG_HOME", must.FilepathAbs(filepath.Join("tests", "global")))
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir: filepath.Join("tests", "single-root-file", "1"),
+					},
+				},
+			},
+			rootDir: must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+			trusted: []bool{false, false, true, true},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file", "1")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", ".xpdt.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "global", "xpdt")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "global", "xpdt", "env.d", "go.toml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "global", "xpdt")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "global", "xpdt", "env.toml")),
+				},
+			},
+		},
+		{
+			name: "no-global",
+			setup: func(st *testing.T) {
+				st.Setenv("XDG_CONFIG_HOME", must.FilepathAbs(filepath.Join("tests", "global")))
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:      filepath.Join("tests", "single-root-file"),
+						NoGlobal: true,
+					},
+				},
+			},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
+				},
+			},
+		},
+		{
+			name: "trusted-dirs",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:         filepath.Join("tests", "single-root-file", "1"),
+						TrustedDirs: []string{must.FilepathAbs(filepath.Join("tests", "single-root-file", "1"))},
+					},
+				},
+			},
+			trusted: []bool{true, false},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file", "1")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", "1", ".xpdt.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
+				},
+			},
+		},
+		{
+			name: "sandbox-off",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:     filepath.Join("tests", "single-root-file"),
+						Sandbox: SandboxOff,
+					},
+				},
+			},
+			trusted: []bool{true},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
+				},
+			},
+		},
+		{
+			name: "sandbox-all",
+			setup: func(st *testing.T) {
+				st.Setenv("XDG_CONFIG_HOME", must.FilepathAbs(filepath.Join("tests", "global")))
+			},
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:         filepath.Join("tests", "single-root-file"),
+						Sandbox:     SandboxAll,
+						TrustedDirs: []string{must.FilepathAbs(filepath.Join("tests", "single-root-file"))},
+					},
+				},
+			},
+			trusted: []bool{false, false, false},
+			files: []*File{
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "single-root-file")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "single-root-file", ".xpdt.yaml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "global", "xpdt")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "global", "xpdt", "env.d", "go.toml")),
+				},
+				{
+					dir:      must.FilepathAbs(filepath.Join("tests", "global", "xpdt")),
+					filepath: must.FilepathAbs(filepath.Join("tests", "global", "xpdt", "env.toml")),
+				},
+			},
+		},
+		{
+			name: "invalid-sandbox",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:     filepath.Join("tests", "single-root-file"),
+						Sandbox: "some",
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "c53ca155-80f8-46a9-911c-193741e84cbe",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.load.sandbox",
+			},
+		},
+		{
+			name: "relative-trusted-dir",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						Dir:         filepath.Join("tests", "single-root-file"),
+						TrustedDirs: []string{"tests"},
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "557faae1-17f3-4b97-9bd2-c2408aea735a",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.load.trustedDirs[0]",
+			},
+		},
+		{
+			name: "relative-ceiling-dir",
+			config: &conf.Config{
+				Env: &conf.Env{
+					Load: &conf.EnvLoad{
+						CeilingDirs: []string{"tests"},
+					},
+				},
+			},
+			err: &klib.Error{
+				ID:     "92453840-2269-466b-a91e-e755533ebae4",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.load.ceilingDirs[0]",
+			},
+		},
 	}
 
 	for i := range testCases {
 		tc := testCases[i]
 
 		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			if tc.setup != nil {
+				tc.setup(st)
+			}
+
 			loader := &Loader{
 				config: tc.config,
 			}
@@ -359,8 +747,673 @@ func TestLoader_FindFiles(t *testing.T) {
 
 					assert.Equal(st, want.dir, have.dir, "File[%d].dir mismatch", i)
 					assert.Equal(st, want.filepath, have.filepath, "File[%d].filepath mismatch", i)
+
+					if tc.trusted != nil {
+						assert.Equal(st, tc.trusted[i], have.trusted, "File[%d].trusted mismatch", i)
+					}
 				}
 			}
+
+			if tc.rootDir != "" {
+				assert.Equal(st, tc.rootDir, loader.data["_ROOT_DIR"], "_ROOT_DIR mismatch")
+			}
 		})
 	}
 }
+
+func TestLoader_writeNotices(t *testing.T) {
+	fileA := &File{dir: "a", filepath: "a/.xpdt.toml"}
+	fileB := &File{dir: "a/b", filepath: "a/b/.xpdt.toml"}
+
+	testCases := []*struct {
+		name          string
+		noNotices     bool
+		previousChain []*chainFile
+		wantOutput    string
+	}{
+		{
+			name:       "new-chain",
+			wantOutput: "xpdt: A\nxpdt: warning: B\n",
+		},
+		{
+			name: "unchanged-chain",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+				{Key: fileB.chainKey()},
+			},
+		},
+		{
+			name: "joined-file",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+			},
+			wantOutput: "xpdt: warning: B\n",
+		},
+		{
+			name:      "no-notices",
+			noNotices: true,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			buf := new(bytes.Buffer)
+
+			loader := &Loader{
+				config: &conf.Config{
+					Env: &conf.Env{
+						Load: &conf.EnvLoad{
+							NoNotices: tc.noNotices,
+						},
+					},
+					Logw: buf,
+				},
+				files: []*File{fileB, fileA},
+				commandMethods: &defaultCommandMethods{
+					notices: []*notice{
+						{level: EchoLevelInfo, message: "A", file: fileA},
+						{level: EchoLevelWarn, message: "B", file: fileB},
+					},
+				},
+			}
+
+			loader.genChain(tc.previousChain)
+			loader.writeNotices()
+
+			assert.Equal(st, tc.wantOutput, buf.String(), "Output mismatch")
+		})
+	}
+}
+
+func TestLoader_runHooks(t *testing.T) {
+	dir := t.TempDir()
+	sep := string(os.PathListSeparator)
+
+	enterA := &Hook{Run: "enter a"}
+	enterB := &Hook{Run: "enter b"}
+	leaveA := &Hook{Run: "leave a"}
+	leaveC := &Hook{Run: "leave c"}
+	leaveD := &Hook{Run: "leave d"}
+
+	fileA := &File{dir: "a", filepath: "a/.xpdt.toml", OnEnter: []*Hook{enterA}, OnLeave: []*Hook{leaveA}, trusted: true}
+	fileB := &File{dir: "a/b", filepath: "a/b/.xpdt.toml", OnEnter: []*Hook{enterB}, trusted: true}
+
+	// Files that left the chain are read for their leave hooks.
+	dirC := filepath.Join(dir, "c")
+	dirD := filepath.Join(dirC, "d")
+	filenameC := filepath.Join(dirC, ".xpdt.toml")
+	filenameD := filepath.Join(dirD, ".xpdt.toml")
+
+	if err := os.MkdirAll(dirD, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filenameC, []byte("[[onLeave]]\nrun = \"leave c\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filenameD, []byte("[[onLeave]]\nrun = \"leave d\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file outside the trusted dirs, recorded with a trusted dir.
+	dirE := filepath.Join(dir, "e")
+	filenameE := filepath.Join(dirE, ".xpdt.toml")
+
+	if err := os.MkdirAll(dirE, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filenameE, []byte("[[onLeave]]\nrun = \"leave e\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	environ := []string{"FOO=bar"}
+
+	testCases := []*struct {
+		name          string
+		previousChain []*chainFile
+		files         []*File
+		trustedDirs   []string
+		mockRunOn     [][]any
+		wantOutput    string
+	}{
+		{
+			name: "enter-all",
+			mockRunOn: [][]any{
+				{enterA, "a", environ, nil},
+				{enterB, "a/b", environ, nil},
+			},
+		},
+		{
+			name: "unchanged-chain",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+				{Key: fileB.chainKey()},
+			},
+		},
+		{
+			name: "leave-and-enter",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+				{Key: dirC + sep + filenameC, Dir: dirC},
+				{Key: dirD + sep + filenameD, Dir: dirD},
+			},
+			trustedDirs: []string{dir},
+			mockRunOn: [][]any{
+				{leaveD, dirD, []string{"ORIGINAL=1"}, nil},
+				{leaveC, dirC, []string{"ORIGINAL=1"}, &klib.Error{Detail: "failed"}},
+				{enterB, "a/b", environ, nil},
+			},
+			wantOutput: "xpdt: warning: ",
+		},
+		{
+			// A chain var set by someone else only runs the hooks of existing files.
+			name: "forged-chain",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+				{Key: fileB.chainKey()},
+				{Key: dirC + sep + filepath.Join(dir, "missing.toml"), Dir: dirC},
+				{Key: "/tmp" + sep + filenameC, Dir: dirC},
+				{Key: filenameD},
+			},
+			trustedDirs: []string{dir},
+		},
+		{
+			// A chain var cannot make a file trusted by recording another dir.
+			name: "forged-chain-dir",
+			previousChain: []*chainFile{
+				{Key: fileA.chainKey()},
+				{Key: fileB.chainKey()},
+				{Key: dirC + sep + filenameE, Dir: dirC},
+			},
+			trustedDirs: []string{dirC},
+		},
+		{
+			// Files outside the trusted dirs, e.g. of a cloned repo, run no hooks.
+			name: "untrusted-files",
+			previousChain: []*chainFile{
+				{Key: dirC + sep + filenameC, Dir: dirC},
+				{Key: dirD + sep + filenameD, Dir: dirD},
+			},
+			files: []*File{
+				{dir: "a/b", filepath: "a/b/.xpdt.toml", OnEnter: []*Hook{enterB}},
+				fileA,
+			},
+			mockRunOn: [][]any{
+				{enterA, "a", environ, nil},
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			buf := new(bytes.Buffer)
+			mockHookRunner := NewMockHookRunner(st)
+			var calls []*mock.Call
+
+			for j := range tc.mockRunOn {
+				on := tc.mockRunOn[j]
+				call := mockHookRunner.On("Run", on[0], on[1], on[2]).Return(on[3]).Once()
+
+				if len(calls) > 0 {
+					call.NotBefore(calls[len(calls)-1])
+				}
+
+				calls = append(calls, call)
+			}
+
+			files := tc.files
+
+			if files == nil {
+				files = []*File{fileB, fileA}
+			}
+
+			loader := &Loader{
+				config: &conf.Config{
+					Env: &conf.Env{
+						Load: &conf.EnvLoad{
+							Environ:     []string{"ORIGINAL=1"},
+							TrustedDirs: tc.trustedDirs,
+						},
+					},
+					Logw: buf,
+				},
+				files: files,
+				container: &container{
+					env: map[string]*environVar{
+						"FOO": {key: "FOO", currentValue: "bar"},
+					},
+				},
+				hookRunner: mockHookRunner,
+			}
+
+			loader.genChain(tc.previousChain)
+
+			err := loader.runHooks()
+			if klib.CheckTestError(st, err, nil) {
+				return
+			}
+
+			assert.True(st, strings.HasPrefix(buf.String(), tc.wantOutput), "Output mismatch: %s", buf.String())
+		})
+	}
+}
+
+func TestLoader_loadShellDefs(t *testing.T) {
+	testCases := []*struct {
+		name          string
+		shell         string
+		files         []*File
+		shellDefs     map[string]*shellDefState
+		err           *klib.Error
+		wantShellDefs map[string]*shellDefState
+	}{
+		{
+			name: "no-shell-keeps-previous",
+			files: []*File{
+				{Aliases: []*ShellDef{{Name: "t", Value: "go test"}}, trusted: true},
+			},
+			shellDefs: map[string]*shellDefState{
+				"ALIAS l": {kind: shellDefAlias, name: "l", previousValue: "ls", previous: true},
+			},
+			wantShellDefs: map[string]*shellDefState{
+				"ALIAS l": {
+					kind:          shellDefAlias,
+					name:          "l",
+					previousValue: "ls",
+					previous:      true,
+					currentValue:  "ls",
+					current:       true,
+				},
+			},
+		},
+		{
+			name:  "child-overrides-root",
+			shell: "zsh",
+			files: []*File{
+				{
+					Aliases: []*ShellDef{{Name: "t", Value: "go test ./..."}},
+					trusted: true,
+				},
+				{
+					Aliases: []*ShellDef{
+						{Name: "t", Value: "go test"},
+						{Name: "b", Value: "bash only", Shell: "bash"},
+					},
+					Functions: []*ShellDef{{Name: "mk", Value: "make", Shell: "ZSH"}},
+					trusted:   true,
+				},
+			},
+			wantShellDefs: map[string]*shellDefState{
+				"ALIAS t": {kind: shellDefAlias, name: "t", currentValue: "go test ./...", current: true},
+				"FUNC mk": {kind: shellDefFunction, name: "mk", currentValue: "make", current: true},
+			},
+		},
+		{
+			name:  "missing-name",
+			shell: "zsh",
+			files: []*File{
+				{Functions: []*ShellDef{{Name: "ok", Value: "true"}, {Value: "false"}}, trusted: true},
+			},
+			err: &klib.Error{
+				ID:     "38e0321b-39dd-450c-8126-084982c7ae57",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".functions[1].name",
+			},
+		},
+		{
+			name:  "untrusted-file-skipped",
+			shell: "zsh",
+			files: []*File{
+				{
+					Aliases:   []*ShellDef{{Name: "ls", Value: "echo untrusted"}},
+					Functions: []*ShellDef{{Name: "cd", Value: "echo untrusted"}},
+				},
+				{
+					Aliases: []*ShellDef{{Name: "t", Value: "go test"}},
+					trusted: true,
+				},
+			},
+			wantShellDefs: map[string]*shellDefState{
+				"ALIAS t": {kind: shellDefAlias, name: "t", currentValue: "go test", current: true},
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			loader := &Loader{
+				config: &conf.Config{
+					Env: &conf.Env{
+						Load: &conf.EnvLoad{
+							Shell: tc.shell,
+						},
+					},
+				},
+				files: tc.files,
+				container: &container{
+					shellDefs: tc.shellDefs,
+				},
+				templateHandler: &templateHandler{},
+			}
+
+			err := loader.loadShellDefs()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantShellDefs, loader.container.shellDefs, "Shell defs mismatch")
+		})
+	}
+}
+
+func TestLoader_loadFileData(t *testing.T) {
+	envFile := filepath.Join(must.FilepathAbs(filepath.Join("tests", "file-data")), ".xpdt.toml")
+
+	testCases := []*struct {
+		name     string
+		files    []*File
+		err      *klib.Error
+		wantData []map[string]any
+	}{
+		{
+			name: "merged-from-root",
+			files: []*File{
+				{
+					dir:      "child",
+					filepath: envFile,
+					Data:     map[string]any{"port": 8081},
+				},
+				{
+					dir: "empty",
+				},
+				{
+					dir:       "root",
+					filepath:  envFile,
+					Data:      map[string]any{"port": 8080, "name": "api"},
+					DataFiles: map[string]string{"versions": "versions.toml"},
+				},
+			},
+			wantData: []map[string]any{
+				{
+					"_PLATFORM": "linux_amd64",
+					"_DIR":      "child",
+					"_FILE":     envFile,
+					"port":      8081,
+					"name":      "api",
+					"versions":  map[string]any{"go": "1.21", "node": "20"},
+				},
+				{
+					"_PLATFORM": "linux_amd64",
+					"_DIR":      "empty",
+					"_FILE":     "",
+					"port":      8080,
+					"name":      "api",
+					"versions":  map[string]any{"go": "1.21", "node": "20"},
+				},
+				{
+					"_PLATFORM": "linux_amd64",
+					"_DIR":      "root",
+					"_FILE":     envFile,
+					"port":      8080,
+					"name":      "api",
+					"versions":  map[string]any{"go": "1.21", "node": "20"},
+				},
+			},
+		},
+		{
+			name: "data-file-not-found",
+			files: []*File{
+				{
+					filepath:  envFile,
+					DataFiles: map[string]string{"missing": "missing.toml"},
+				},
+			},
+			err: &klib.Error{
+				ID:     "145a329c-9fe2-493a-ac6f-e70603dae4ec",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Path:   ".dataFiles[missing]",
+			},
+		},
+		{
+			name: "encrypted-data-file-untrusted",
+			files: []*File{
+				{
+					filepath:  envFile,
+					DataFiles: map[string]string{"secrets": "secrets.env.enc"},
+				},
+			},
+			err: &klib.Error{
+				ID:     "a9504206-3277-4d41-a8fe-272e21d4f2d4",
+				Status: http.StatusForbidden,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".dataFiles[secrets]",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			loader := &Loader{
+				data:  map[string]any{"_PLATFORM": "linux_amd64"},
+				files: tc.files,
+			}
+
+			err := loader.loadFileData()
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			for j := range tc.files {
+				assert.Equal(st, tc.wantData[j], tc.files[j].data, "File[%d].data mismatch", j)
+			}
+		})
+	}
+}
+
+func TestLoader_useFileData(t *testing.T) {
+	repoDir := t.TempDir()
+	subDir := filepath.Join(repoDir, "sub")
+
+	if err := os.MkdirAll(filepath.Join(subDir, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []*struct {
+		name           string
+		file           *File
+		wantData       map[string]any
+		wantRestricted bool
+		wantSandboxDir string
+	}{
+		{
+			name: "trusted",
+			file: &File{
+				data:    map[string]any{"foo": "bar"},
+				trusted: true,
+			},
+			wantData: map[string]any{"foo": "bar"},
+		},
+		{
+			name:           "untrusted",
+			file:           &File{},
+			wantRestricted: true,
+		},
+		{
+			name: "untrusted-without-git-root",
+			file: &File{
+				dir: repoDir,
+			},
+			wantRestricted: true,
+			wantSandboxDir: repoDir,
+		},
+		{
+			name: "untrusted-in-git-root",
+			file: &File{
+				dir: filepath.Join(subDir, "a"),
+			},
+			wantRestricted: true,
+			wantSandboxDir: subDir,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			mockTemplateHandler := NewMockTemplateHandler(st)
+			mockTemplateHandler.EXPECT().UseFile(tc.wantData, tc.wantRestricted, tc.wantSandboxDir).Return().Once()
+
+			loader := &Loader{
+				templateHandler: mockTemplateHandler,
+			}
+
+			loader.useFileData(tc.file)
+		})
+	}
+}
+
+func TestLoader_genTemplateHandler(t *testing.T) {
+	binDir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(binDir, "tool"), nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := &Loader{
+		config: &conf.Config{
+			Env: &conf.Env{
+				Load: &conf.EnvLoad{},
+			},
+		},
+		container: &container{
+			caseInsensitiveEnvironment: true,
+			env: map[string]*environVar{
+				"FOO":  {key: "FOO", originalValue: "old", currentValue: "new"},
+				"BAR":  {key: "BAR", originalValue: "bar", delete: true},
+				"PATH": {key: "PATH", currentValue: binDir},
+			},
+		},
+	}
+
+	if err := loader.genTemplateHandler(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []*struct {
+		input  string
+		output string
+	}{
+		{input: `{{ env "foo" }}`, output: "new"},
+		{input: `{{ origEnv "foo" }}`, output: "old"},
+		{input: `{{ env "BAR" }}`, output: ""},
+		{input: `{{ origEnv "BAR" }}`, output: "bar"},
+		{input: `{{ origEnv "MISSING" }}`, output: ""},
+		{input: `{{ which "tool" }}`, output: filepath.Join(binDir, "tool")},
+		{input: `{{ dirExists "` + filepath.ToSlash(binDir) + `" }}`, output: "true"},
+		{input: `{{ rel "/a" "/a/b/c" }}`, output: filepath.Join("b", "c")},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.input), func(st *testing.T) {
+			if runtime.GOOS == "windows" && strings.Contains(tc.input, "which") {
+				st.Skip("executables are looked up by PATHEXT")
+			}
+
+			have, err := loader.templateHandler.Handle(tc.input)
+			if klib.CheckTestError(st, err, nil) {
+				return
+			}
+
+			assert.Equal(st, tc.output, have, "Template output mismatch")
+		})
+	}
+
+	t.Run("after-add-path", func(st *testing.T) {
+		if runtime.GOOS == "windows" {
+			st.Skip("executables are looked up by PATHEXT")
+		}
+
+		otherBinDir := st.TempDir()
+
+		if err := os.WriteFile(filepath.Join(otherBinDir, "other"), nil, 0o755); err != nil {
+			st.Fatal(err)
+		}
+
+		pathHandler := &defaultPathHandler{caseSensitiveFilesystem: true}
+		commandMethods := &defaultCommandMethods{
+			container:       loader.container,
+			pathHandler:     pathHandler,
+			pathLoader:      &defaultPathLoader{pathHandler: pathHandler},
+			templateHandler: loader.templateHandler,
+		}
+
+		if err := commandMethods.Add(&Command{Add: "PATH", Value: otherBinDir, Append: true}); err != nil {
+			st.Fatal(err)
+		}
+
+		for input, output := range map[string]string{
+			`{{ env "PATH" }}`:    binDir + string(os.PathListSeparator) + otherBinDir,
+			`{{ which "tool" }}`:  filepath.Join(binDir, "tool"),
+			`{{ which "other" }}`: filepath.Join(otherBinDir, "other"),
+		} {
+			have, err := loader.templateHandler.Handle(input)
+			if assert.NoError(st, err) {
+				assert.Equal(st, output, have, "Template output mismatch: %s", input)
+			}
+		}
+	})
+
+	t.Run("untrusted-below-parent-file", func(st *testing.T) {
+		// The topmost file of the chain, e.g. in the home dir, is above the project.
+		parentDir := st.TempDir()
+		projectDir := filepath.Join(parentDir, "project")
+
+		if err := os.MkdirAll(filepath.Join(projectDir, ".git"), 0o755); err != nil {
+			st.Fatal(err)
+		}
+
+		for _, path := range []string{
+			filepath.Join(parentDir, "credentials"),
+			filepath.Join(projectDir, "config"),
+		} {
+			if err := os.WriteFile(path, []byte("value"), 0o644); err != nil {
+				st.Fatal(err)
+			}
+		}
+
+		loader.useFileData(&File{dir: projectDir})
+		defer loader.useFileData(&File{trusted: true})
+
+		have, err := loader.templateHandler.Handle(`{{ readFile "` + filepath.ToSlash(filepath.Join(projectDir, "config")) + `" }}`)
+		if assert.NoError(st, err) {
+			assert.Equal(st, "value", have, "Template output mismatch")
+		}
+
+		for _, input := range []string{
+			`{{ fileExists "` + filepath.ToSlash(filepath.Join(parentDir, "credentials")) + `" }}`,
+			`{{ glob "` + filepath.ToSlash(filepath.Join(parentDir, "cred*")) + `" | len }}`,
+		} {
+			have, err := loader.templateHandler.Handle(input)
+			if assert.NoError(st, err) {
+				assert.Contains(st, []string{"false", "0"}, have, "Template output mismatch: %s", input)
+			}
+		}
+
+		_, err = loader.templateHandler.Handle(`{{ readFile "` + filepath.ToSlash(filepath.Join(parentDir, "credentials")) + `" }}`)
+		assert.Error(st, err, "Parent file was read")
+	})
+}
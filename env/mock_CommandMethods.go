@@ -59,6 +59,48 @@ func (_c *MockCommandMethods_Add_Call) RunAndReturn(run func(*Command) error) *M
 	return _c
 }
 
+// Default provides a mock function with given fields: cmd
+func (_m *MockCommandMethods) Default(cmd *Command) error {
+	ret := _m.Called(cmd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Command) error); ok {
+		r0 = rf(cmd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockCommandMethods_Default_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Default'
+type MockCommandMethods_Default_Call struct {
+	*mock.Call
+}
+
+// Default is a helper method to define mock.On call
+//   - cmd *Command
+func (_e *MockCommandMethods_Expecter) Default(cmd interface{}) *MockCommandMethods_Default_Call {
+	return &MockCommandMethods_Default_Call{Call: _e.mock.On("Default", cmd)}
+}
+
+func (_c *MockCommandMethods_Default_Call) Run(run func(cmd *Command)) *MockCommandMethods_Default_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*Command))
+	})
+	return _c
+}
+
+func (_c *MockCommandMethods_Default_Call) Return(_a0 error) *MockCommandMethods_Default_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockCommandMethods_Default_Call) RunAndReturn(run func(*Command) error) *MockCommandMethods_Default_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Del provides a mock function with given fields: cmd
 func (_m *MockCommandMethods) Del(cmd *Command) error {
 	ret := _m.Called(cmd)
@@ -101,6 +143,132 @@ func (_c *MockCommandMethods_Del_Call) RunAndReturn(run func(*Command) error) *M
 	return _c
 }
 
+// Echo provides a mock function with given fields: cmd
+func (_m *MockCommandMethods) Echo(cmd *Command) error {
+	ret := _m.Called(cmd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Command) error); ok {
+		r0 = rf(cmd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockCommandMethods_Echo_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Echo'
+type MockCommandMethods_Echo_Call struct {
+	*mock.Call
+}
+
+// Echo is a helper method to define mock.On call
+//   - cmd *Command
+func (_e *MockCommandMethods_Expecter) Echo(cmd interface{}) *MockCommandMethods_Echo_Call {
+	return &MockCommandMethods_Echo_Call{Call: _e.mock.On("Echo", cmd)}
+}
+
+func (_c *MockCommandMethods_Echo_Call) Run(run func(cmd *Command)) *MockCommandMethods_Echo_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*Command))
+	})
+	return _c
+}
+
+func (_c *MockCommandMethods_Echo_Call) Return(_a0 error) *MockCommandMethods_Echo_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockCommandMethods_Echo_Call) RunAndReturn(run func(*Command) error) *MockCommandMethods_Echo_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Extend provides a mock function with given fields: cmd
+func (_m *MockCommandMethods) Extend(cmd *Command) error {
+	ret := _m.Called(cmd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Command) error); ok {
+		r0 = rf(cmd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockCommandMethods_Extend_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Extend'
+type MockCommandMethods_Extend_Call struct {
+	*mock.Call
+}
+
+// Extend is a helper method to define mock.On call
+//   - cmd *Command
+func (_e *MockCommandMethods_Expecter) Extend(cmd interface{}) *MockCommandMethods_Extend_Call {
+	return &MockCommandMethods_Extend_Call{Call: _e.mock.On("Extend", cmd)}
+}
+
+func (_c *MockCommandMethods_Extend_Call) Run(run func(cmd *Command)) *MockCommandMethods_Extend_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*Command))
+	})
+	return _c
+}
+
+func (_c *MockCommandMethods_Extend_Call) Return(_a0 error) *MockCommandMethods_Extend_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockCommandMethods_Extend_Call) RunAndReturn(run func(*Command) error) *MockCommandMethods_Extend_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Require provides a mock function with given fields: cmd
+func (_m *MockCommandMethods) Require(cmd *Command) error {
+	ret := _m.Called(cmd)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*Command) error); ok {
+		r0 = rf(cmd)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockCommandMethods_Require_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Require'
+type MockCommandMethods_Require_Call struct {
+	*mock.Call
+}
+
+// Require is a helper method to define mock.On call
+//   - cmd *Command
+func (_e *MockCommandMethods_Expecter) Require(cmd interface{}) *MockCommandMethods_Require_Call {
+	return &MockCommandMethods_Require_Call{Call: _e.mock.On("Require", cmd)}
+}
+
+func (_c *MockCommandMethods_Require_Call) Run(run func(cmd *Command)) *MockCommandMethods_Require_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*Command))
+	})
+	return _c
+}
+
+func (_c *MockCommandMethods_Require_Call) Return(_a0 error) *MockCommandMethods_Require_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockCommandMethods_Require_Call) RunAndReturn(run func(*Command) error) *MockCommandMethods_Require_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Set provides a mock function with given fields: cmd
 func (_m *MockCommandMethods) Set(cmd *Command) error {
 	ret := _m.Called(cmd)
@@ -18,17 +18,27 @@ func (_m *MockPathHandler) EXPECT() *MockPathHandler_Expecter {
 }
 
 // Add provides a mock function with given fields: envVar, value, position
-func (_m *MockPathHandler) Add(envVar *environVar, value string, position int) error {
+func (_m *MockPathHandler) Add(envVar *environVar, value string, position int) (bool, error) {
 	ret := _m.Called(envVar, value, position)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(*environVar, string, int) error); ok {
+	var r0 bool
+	var r1 error
+	if rf, ok := ret.Get(0).(func(*environVar, string, int) (bool, error)); ok {
+		return rf(envVar, value, position)
+	}
+	if rf, ok := ret.Get(0).(func(*environVar, string, int) bool); ok {
 		r0 = rf(envVar, value, position)
 	} else {
-		r0 = ret.Error(0)
+		r0 = ret.Get(0).(bool)
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(*environVar, string, int) error); ok {
+		r1 = rf(envVar, value, position)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
 }
 
 // MockPathHandler_Add_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Add'
@@ -51,12 +61,108 @@ func (_c *MockPathHandler_Add_Call) Run(run func(envVar *environVar, value strin
 	return _c
 }
 
-func (_c *MockPathHandler_Add_Call) Return(_a0 error) *MockPathHandler_Add_Call {
+func (_c *MockPathHandler_Add_Call) Return(_a0 bool, _a1 error) *MockPathHandler_Add_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockPathHandler_Add_Call) RunAndReturn(run func(*environVar, string, int) (bool, error)) *MockPathHandler_Add_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Index provides a mock function with given fields: envVar, value
+func (_m *MockPathHandler) Index(envVar *environVar, value string) (int, error) {
+	ret := _m.Called(envVar, value)
+
+	var r0 int
+	var r1 error
+	if rf, ok := ret.Get(0).(func(*environVar, string) (int, error)); ok {
+		return rf(envVar, value)
+	}
+	if rf, ok := ret.Get(0).(func(*environVar, string) int); ok {
+		r0 = rf(envVar, value)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	if rf, ok := ret.Get(1).(func(*environVar, string) error); ok {
+		r1 = rf(envVar, value)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockPathHandler_Index_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Index'
+type MockPathHandler_Index_Call struct {
+	*mock.Call
+}
+
+// Index is a helper method to define mock.On call
+//   - envVar *environVar
+//   - value string
+func (_e *MockPathHandler_Expecter) Index(envVar interface{}, value interface{}) *MockPathHandler_Index_Call {
+	return &MockPathHandler_Index_Call{Call: _e.mock.On("Index", envVar, value)}
+}
+
+func (_c *MockPathHandler_Index_Call) Run(run func(envVar *environVar, value string)) *MockPathHandler_Index_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*environVar), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *MockPathHandler_Index_Call) Return(_a0 int, _a1 error) *MockPathHandler_Index_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockPathHandler_Index_Call) RunAndReturn(run func(*environVar, string) (int, error)) *MockPathHandler_Index_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Remove provides a mock function with given fields: envVar, value
+func (_m *MockPathHandler) Remove(envVar *environVar, value string) error {
+	ret := _m.Called(envVar, value)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*environVar, string) error); ok {
+		r0 = rf(envVar, value)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockPathHandler_Remove_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Remove'
+type MockPathHandler_Remove_Call struct {
+	*mock.Call
+}
+
+// Remove is a helper method to define mock.On call
+//   - envVar *environVar
+//   - value string
+func (_e *MockPathHandler_Expecter) Remove(envVar interface{}, value interface{}) *MockPathHandler_Remove_Call {
+	return &MockPathHandler_Remove_Call{Call: _e.mock.On("Remove", envVar, value)}
+}
+
+func (_c *MockPathHandler_Remove_Call) Run(run func(envVar *environVar, value string)) *MockPathHandler_Remove_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*environVar), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *MockPathHandler_Remove_Call) Return(_a0 error) *MockPathHandler_Remove_Call {
 	_c.Call.Return(_a0)
 	return _c
 }
 
-func (_c *MockPathHandler_Add_Call) RunAndReturn(run func(*environVar, string, int) error) *MockPathHandler_Add_Call {
+func (_c *MockPathHandler_Remove_Call) RunAndReturn(run func(*environVar, string) error) *MockPathHandler_Remove_Call {
 	_c.Call.Return(run)
 	return _c
 }
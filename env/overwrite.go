@@ -0,0 +1,367 @@
+package env
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+// overwriteMatcher matches the directories an overwrite applies to.
+type overwriteMatcher struct {
+	overwrite *conf.EnvOverwrite
+	index     int
+
+	// The directory, or glob, the overwrite applies to.
+	// If remote is set, it is relative to the git root.
+	dir  string
+	glob bool
+
+	// The normalized git remote URL, or glob.
+	remote string
+}
+
+// overwriteMatchers matches the overwrites of a directory,
+// caching the git roots and remotes of the directories.
+type overwriteMatchers struct {
+	matchers []*overwriteMatcher
+
+	// Where the overwrites are applied.
+	hostname string
+	username string
+	platform string
+
+	gitRoots   map[string]string
+	gitRemotes map[string][]string
+}
+
+func newOverwriteMatchers(overwrites []*conf.EnvOverwrite, platform string) (*overwriteMatchers, error) {
+	ms := &overwriteMatchers{
+		platform:   platform,
+		gitRoots:   make(map[string]string),
+		gitRemotes: make(map[string][]string),
+	}
+
+	for i := range overwrites {
+		overwrite := overwrites[i]
+
+		for _, filter := range []struct {
+			path     string
+			patterns []string
+		}{
+			{"hosts", overwrite.Hosts},
+			{"users", overwrite.Users},
+			{"platforms", overwrite.Platforms},
+		} {
+			for j := range filter.patterns {
+				if _, err := path.Match(filter.patterns[j], ""); err != nil {
+					return nil, &klib.Error{
+						ID:     "0e15c182-1afb-46e1-9feb-2a747246da54",
+						Status: http.StatusBadRequest,
+						Code:   klib.CodeInvalidValue,
+						Path:   fmt.Sprintf(".env.overwrites[%d].%s[%d]", i, filter.path, j),
+						Detail: "Invalid overwrite filter glob.",
+						Cause:  err.Error(),
+						Meta: map[string]any{
+							"#i":      i,
+							"pattern": filter.patterns[j],
+						},
+					}
+				}
+			}
+		}
+
+		// Failing to know where overwrites are applied fails the load,
+		// rather than silently matching or not matching them.
+		if len(overwrite.Hosts) > 0 && ms.hostname == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, &klib.Error{
+					ID:     "87735b40-fb86-4921-ab42-e3e6cf2d5310",
+					Status: http.StatusInternalServerError,
+					Code:   klib.CodeExecutionError,
+					Path:   fmt.Sprintf(".env.overwrites[%d].hosts", i),
+					Title:  "Failed to get hostname",
+					Cause:  err.Error(),
+				}
+			}
+
+			ms.hostname = hostname
+		}
+
+		if len(overwrite.Users) > 0 && ms.username == "" {
+			u, err := user.Current()
+			if err != nil {
+				return nil, &klib.Error{
+					ID:     "40b86482-6491-4360-a7ee-c032819d6c3d",
+					Status: http.StatusInternalServerError,
+					Code:   klib.CodeExecutionError,
+					Path:   fmt.Sprintf(".env.overwrites[%d].users", i),
+					Title:  "Failed to get current user",
+					Cause:  err.Error(),
+				}
+			}
+
+			ms.username = u.Username
+		}
+
+		overwriteDir := strings.TrimSpace(overwrite.Dir)
+		remote := strings.TrimSpace(overwrite.Remote)
+
+		if overwriteDir == "" {
+			if remote == "" {
+				return nil, &klib.Error{
+					ID:     "dc558b94-ddf9-4280-8eab-94e16cc79418",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeMissingValue,
+					Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
+					Detail: "Overwrite dir cannot be empty.",
+					Meta: map[string]any{
+						"#i":  i,
+						"dir": overwrite.Dir,
+					},
+				}
+			}
+
+			// The git root.
+			overwriteDir = "."
+		}
+
+		overwriteDir, err := expandTilde(overwriteDir)
+		if err != nil {
+			return nil, klib.ForwardError("0635207f-7f2e-4cc4-8236-b661cce1742a", err)
+		}
+
+		cleanDir := filepath.Clean(overwriteDir)
+
+		if remote == "" && !filepath.IsAbs(cleanDir) {
+			return nil, &klib.Error{
+				ID:     "8ee66ad2-84e7-4aa1-8151-55af5c6f4b7d",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
+				Detail: "Overwrite dir must be absolute.",
+				Meta: map[string]any{
+					"#i":  i,
+					"dir": overwrite.Dir,
+				},
+			}
+		}
+
+		if remote != "" && filepath.IsAbs(cleanDir) {
+			return nil, &klib.Error{
+				ID:     "ed79a411-3e51-4296-a862-7f9c21e85c0e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
+				Detail: "Overwrite dir must be relative to the git root if remote is set.",
+				Meta: map[string]any{
+					"#i":  i,
+					"dir": overwrite.Dir,
+				},
+			}
+		}
+
+		if _, err := filepath.Match(cleanDir, ""); err != nil {
+			return nil, &klib.Error{
+				ID:     "92eb947f-28f6-4da5-81b8-ee0598d1c32f",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   fmt.Sprintf(".env.overwrites[%d].dir", i),
+				Detail: "Invalid overwrite dir glob.",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"#i":  i,
+					"dir": overwrite.Dir,
+				},
+			}
+		}
+
+		if remote != "" {
+			remote = normalizeGitRemote(remote)
+
+			if _, err := path.Match(remote, ""); err != nil {
+				return nil, &klib.Error{
+					ID:     "3b88dd26-9e37-4071-899f-be5b06d68cc9",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeInvalidValue,
+					Path:   fmt.Sprintf(".env.overwrites[%d].remote", i),
+					Detail: "Invalid overwrite remote glob.",
+					Cause:  err.Error(),
+					Meta: map[string]any{
+						"#i":     i,
+						"remote": overwrite.Remote,
+					},
+				}
+			}
+		}
+
+		ms.matchers = append(ms.matchers, &overwriteMatcher{
+			overwrite: overwrite,
+			index:     i,
+			dir:       cleanDir,
+			glob:      strings.ContainsAny(cleanDir, "*?["),
+			remote:    remote,
+		})
+	}
+
+	return ms, nil
+}
+
+// match returns the overwrites of dir, in the order they were declared.
+func (ms *overwriteMatchers) match(dir string) ([]*conf.EnvOverwrite, error) {
+	var overwrites []*conf.EnvOverwrite
+
+	for _, m := range ms.matchers {
+		target := dir
+		gitRoot := ""
+
+		if m.remote != "" {
+			gitRoot = ms.gitRoot(dir)
+			if gitRoot == "" {
+				continue
+			}
+
+			var err error
+
+			target, err = filepath.Rel(gitRoot, dir)
+			if err != nil {
+				continue
+			}
+		}
+
+		if m.glob {
+			// The pattern is validated by newOverwriteMatchers.
+			if ok, _ := filepath.Match(m.dir, target); !ok {
+				continue
+			}
+		} else if m.dir != target {
+			continue
+		}
+
+		if reason := ms.filter(m.overwrite); reason != "" {
+			log.Debug().
+				Str("_label", "overwriteNotApplied").
+				Int("overwriteIndex", m.index).
+				Str("dir", dir).
+				Str("reason", reason).
+				Send()
+
+			continue
+		}
+
+		// The remotes are matched last, since getting them runs git.
+		if m.remote != "" {
+			ok, err := ms.matchRemote(gitRoot, m.remote)
+			if err != nil {
+				return nil, klib.ForwardError("af436cdb-b337-4875-bf53-0f2ed0093cf0", err)
+			}
+
+			if !ok {
+				continue
+			}
+		}
+
+		log.Debug().
+			Str("_label", "overwriteApplied").
+			Int("overwriteIndex", m.index).
+			Str("dir", dir).
+			Str("matchedDir", m.dir).
+			Str("matchedRemote", m.remote).
+			Send()
+
+		overwrites = append(overwrites, m.overwrite)
+	}
+
+	return overwrites, nil
+}
+
+// filter returns why overwrite does not apply where it is loaded,
+// or an empty string if it does.
+func (ms *overwriteMatchers) filter(overwrite *conf.EnvOverwrite) string {
+	for _, filter := range []struct {
+		name     string
+		value    string
+		patterns []string
+	}{
+		{"host", strings.ToLower(ms.hostname), overwrite.Hosts},
+		{"user", ms.username, overwrite.Users},
+		{"platform", ms.platform, overwrite.Platforms},
+	} {
+		if len(filter.patterns) == 0 {
+			continue
+		}
+
+		matched := false
+
+		for _, pattern := range filter.patterns {
+			if filter.name == "host" {
+				// Hostnames are case insensitive.
+				pattern = strings.ToLower(pattern)
+			}
+
+			// The patterns are validated by newOverwriteMatchers.
+			if ok, _ := path.Match(pattern, filter.value); ok {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return fmt.Sprintf("%s %q does not match %s", filter.name, filter.value, strings.Join(filter.patterns, ", "))
+		}
+	}
+
+	return ""
+}
+
+// gitRoot returns the git root of dir, or an empty string if there is none.
+func (ms *overwriteMatchers) gitRoot(dir string) string {
+	gitRoot, ok := ms.gitRoots[dir]
+
+	if !ok {
+		gitRoot = findGitRoot(dir)
+		ms.gitRoots[dir] = gitRoot
+	}
+
+	return gitRoot
+}
+
+// matchRemote returns whether the git repository at gitRoot
+// has a remote URL that matches remote.
+func (ms *overwriteMatchers) matchRemote(gitRoot, remote string) (bool, error) {
+	remotes, ok := ms.gitRemotes[gitRoot]
+
+	if !ok {
+		var err error
+
+		remotes, err = gitRemotes(gitRoot)
+		if err != nil {
+			return false, klib.ForwardError("4605f013-718a-427c-ba13-094b4dadf274", err)
+		}
+
+		ms.gitRemotes[gitRoot] = remotes
+
+		log.Debug().
+			Str("_label", "gitRemotes").
+			Str("dir", gitRoot).
+			Strs("remotes", remotes).
+			Send()
+	}
+
+	for i := range remotes {
+		if ok, _ := path.Match(remote, remotes[i]); ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,154 @@
+package env
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+func Test_overwriteMatchers_match(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	repo := filepath.Join(home, "src", "team", "repo")
+
+	// A repository whose remotes cannot be read, since it does not exist.
+	missingRepo := filepath.Join(home, "src", "team", "missing")
+
+	literal := &conf.EnvOverwrite{Dir: filepath.Join(repo, "service-a"), File: "literal.toml"}
+	glob := &conf.EnvOverwrite{Dir: "~/src/*/repo/service-*", File: "glob.toml"}
+	remoteRoot := &conf.EnvOverwrite{Remote: "git@github.com:team/*.git", File: "remote-root.toml"}
+	remoteDir := &conf.EnvOverwrite{Remote: "github.com/team/repo", Dir: "service-?", File: "remote-dir.toml"}
+	otherRemote := &conf.EnvOverwrite{Remote: "github.com/other/*", File: "other.toml"}
+
+	linuxHost := &conf.EnvOverwrite{
+		Dir:       filepath.Join(repo, "service-a"),
+		Hosts:     []string{"ci-*", "laptop"},
+		Platforms: []string{"linux_*"},
+		File:      "linux-host.toml",
+	}
+	otherUser := &conf.EnvOverwrite{Dir: filepath.Join(repo, "service-a"), Users: []string{"root"}, Skip: true}
+	remoteOtherUser := &conf.EnvOverwrite{Remote: "github.com/team/*", Users: []string{"root"}, File: "remote-root-user.toml"}
+
+	testCases := []*struct {
+		name       string
+		overwrites []*conf.EnvOverwrite
+		dir        string
+		err        *klib.Error
+		want       []*conf.EnvOverwrite
+	}{
+		{
+			name:       "invalid-filter-glob",
+			overwrites: []*conf.EnvOverwrite{{Dir: repo, Users: []string{"dev", "["}}},
+			err: &klib.Error{
+				ID:     "0e15c182-1afb-46e1-9feb-2a747246da54",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.overwrites[0].users[1]",
+			},
+		},
+		{
+			name:       "filters",
+			overwrites: []*conf.EnvOverwrite{linuxHost, otherUser},
+			dir:        filepath.Join(repo, "service-a"),
+			want:       []*conf.EnvOverwrite{linuxHost},
+		},
+		{
+			name:       "empty-dir-and-remote",
+			overwrites: []*conf.EnvOverwrite{{}},
+			err: &klib.Error{
+				ID:     "dc558b94-ddf9-4280-8eab-94e16cc79418",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".env.overwrites[0].dir",
+			},
+		},
+		{
+			name:       "absolute-dir-with-remote",
+			overwrites: []*conf.EnvOverwrite{{Remote: "github.com/team/repo", Dir: repo}},
+			err: &klib.Error{
+				ID:     "ed79a411-3e51-4296-a862-7f9c21e85c0e",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.overwrites[0].dir",
+			},
+		},
+		{
+			name:       "invalid-glob",
+			overwrites: []*conf.EnvOverwrite{{Dir: "/src/["}},
+			err: &klib.Error{
+				ID:     "92eb947f-28f6-4da5-81b8-ee0598d1c32f",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.overwrites[0].dir",
+			},
+		},
+		{
+			name:       "invalid-remote-glob",
+			overwrites: []*conf.EnvOverwrite{{Remote: "github.com/["}},
+			err: &klib.Error{
+				ID:     "3b88dd26-9e37-4071-899f-be5b06d68cc9",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".env.overwrites[0].remote",
+			},
+		},
+		{
+			name:       "git-root",
+			overwrites: []*conf.EnvOverwrite{literal, glob, remoteRoot, remoteDir, otherRemote},
+			dir:        repo,
+			want:       []*conf.EnvOverwrite{remoteRoot},
+		},
+		{
+			name:       "service-dir",
+			overwrites: []*conf.EnvOverwrite{literal, glob, remoteRoot, remoteDir, otherRemote},
+			dir:        filepath.Join(repo, "service-a"),
+			want:       []*conf.EnvOverwrite{literal, glob, remoteDir},
+		},
+		{
+			// The remotes are not read when the dir or filters do not match.
+			name:       "remote-not-needed",
+			overwrites: []*conf.EnvOverwrite{remoteDir, remoteOtherUser},
+			dir:        missingRepo,
+		},
+		{
+			name:       "outside-repo",
+			overwrites: []*conf.EnvOverwrite{literal, glob, remoteRoot, remoteDir, otherRemote},
+			dir:        home,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			ms, err := newOverwriteMatchers(tc.overwrites, "linux_amd64")
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			ms.hostname = "Laptop"
+			ms.username = "dev"
+
+			// Avoid looking up git repositories.
+			ms.gitRoots[home] = ""
+			ms.gitRoots[repo] = repo
+			ms.gitRoots[filepath.Join(repo, "service-a")] = repo
+			ms.gitRoots[missingRepo] = missingRepo
+			ms.gitRemotes[repo] = []string{"github.com/team/repo"}
+
+			have, err := ms.match(tc.dir)
+			if klib.CheckTestError(st, err, nil) {
+				return
+			}
+
+			assert.Equal(st, tc.want, have, "Overwrites mismatch")
+		})
+	}
+}
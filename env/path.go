@@ -1,44 +1,39 @@
 package env
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/rs/zerolog/log"
 	"go.katupy.io/klib"
 )
 
 type PathHandler interface {
-	Add(envVar *environVar, value string, position int) error
+	// Add inserts value at position, or appends it if position is -1,
+	// and returns whether it was inserted, which it is not if it already exists.
+	Add(envVar *environVar, value string, position int) (bool, error)
+	Index(envVar *environVar, value string) (int, error)
+	Remove(envVar *environVar, value string) error
 }
 
 type defaultPathHandler struct {
 	caseSensitiveFilesystem bool
+
+	// Whether symlinks are resolved when comparing path list elements,
+	// so different paths to the same directory are only added once.
+	resolveSymlinks bool
 }
 
-func (h *defaultPathHandler) Add(envVar *environVar, value string, index int) error {
-	cleanValue, err := filepath.Abs(strings.TrimSpace(value))
+func (h *defaultPathHandler) Add(envVar *environVar, value string, index int) (bool, error) {
+	cleanValue, compareValue, err := h.clean(envVar, value)
 	if err != nil {
-		return &klib.Error{
-			ID:     "0d3fb866-c0be-420d-89e7-11b0f05ff132",
-			Status: http.StatusInternalServerError,
-			Code:   klib.CodeFilesystemError,
-			Detail: fmt.Sprintf("Failed to calculate absolute path value for key %s: %s.", envVar.key, value),
-			Cause:  err.Error(),
-			Meta: map[string]any{
-				"key":   envVar.key,
-				"value": value,
-			},
-		}
-	}
-
-	compareValue := cleanValue
-
-	// On case-insensitive filesystems, prevent duplicate paths with different casing.
-	if !h.caseSensitiveFilesystem {
-		compareValue = strings.ToUpper(cleanValue)
+		return false, klib.ForwardError("7681640a-8c41-44dd-b189-40a46934e409", err)
 	}
 
 	if envVar.pathListElementExists == nil {
@@ -47,7 +42,7 @@ func (h *defaultPathHandler) Add(envVar *environVar, value string, index int) er
 
 	// The provided path is already in the list.
 	if envVar.pathListElementExists[compareValue] {
-		return nil
+		return false, nil
 	}
 
 	envVar.pathListElementExists[compareValue] = true
@@ -58,18 +53,100 @@ func (h *defaultPathHandler) Add(envVar *environVar, value string, index int) er
 		index,
 	)
 	if err != nil {
-		return klib.ForwardError("570e1095-1818-45f7-aaa8-97b53fa224e3", err)
+		return false, klib.ForwardError("570e1095-1818-45f7-aaa8-97b53fa224e3", err)
+	}
+
+	return true, nil
+}
+
+// Index returns the index of value in the path list of envVar,
+// or -1 if value is not an element of the list.
+func (h *defaultPathHandler) Index(envVar *environVar, value string) (int, error) {
+	_, compareValue, err := h.clean(envVar, value)
+	if err != nil {
+		return -1, klib.ForwardError("ce76ea05-9616-4deb-a402-f861aff1ec3c", err)
+	}
+
+	if !envVar.pathListElementExists[compareValue] {
+		return -1, nil
+	}
+
+	for i := range envVar.pathListElements {
+		if h.compareValue(envVar.pathListElements[i]) == compareValue {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// Remove removes value from the path list of envVar, if present.
+func (h *defaultPathHandler) Remove(envVar *environVar, value string) error {
+	index, err := h.Index(envVar, value)
+	if err != nil {
+		return klib.ForwardError("d49efce1-963b-47bb-a390-2707f4395f94", err)
 	}
 
+	if index < 0 {
+		return nil
+	}
+
+	delete(envVar.pathListElementExists, h.compareValue(envVar.pathListElements[index]))
+	envVar.pathListElements = append(envVar.pathListElements[:index], envVar.pathListElements[index+1:]...)
+
 	return nil
 }
 
+// clean returns the absolute path of value and
+// the value used to compare it with other path list elements.
+func (h *defaultPathHandler) clean(envVar *environVar, value string) (string, string, error) {
+	cleanValue, err := filepath.Abs(strings.TrimSpace(value))
+	if err != nil {
+		return "", "", &klib.Error{
+			ID:     "0d3fb866-c0be-420d-89e7-11b0f05ff132",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeFilesystemError,
+			Detail: fmt.Sprintf("Failed to calculate absolute path value for key %s: %s.", envVar.key, value),
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"key":   envVar.key,
+				"value": value,
+			},
+		}
+	}
+
+	return cleanValue, h.compareValue(cleanValue), nil
+}
+
+func (h *defaultPathHandler) compareValue(cleanValue string) string {
+	compareValue := cleanValue
+
+	if h.resolveSymlinks {
+		// Paths that cannot be resolved, e.g. because they do not exist,
+		// are compared as they are.
+		if resolvedValue, err := filepath.EvalSymlinks(cleanValue); err == nil {
+			compareValue = resolvedValue
+		}
+	}
+
+	// On case-insensitive filesystems, prevent duplicate paths with different casing.
+	if !h.caseSensitiveFilesystem {
+		return strings.ToUpper(compareValue)
+	}
+
+	return compareValue
+}
+
 type PathLoader interface {
 	Load(envVar *environVar) error
 }
 
 type defaultPathLoader struct {
 	pathHandler PathHandler
+
+	// Whether elements that do not exist in the filesystem
+	// are dropped from the loaded path list.
+	prune bool
 }
 
 func (l *defaultPathLoader) Load(envVar *environVar) error {
@@ -95,10 +172,134 @@ func (l *defaultPathLoader) Load(envVar *environVar) error {
 			continue
 		}
 
-		if err := l.pathHandler.Add(envVar, element, -1); err != nil {
+		if l.prune {
+			if _, err := os.Stat(element); err != nil {
+				log.Debug().
+					Str("_label", "pathElementPruned").
+					Str("key", envVar.key).
+					Str("element", element).
+					Send()
+
+				continue
+			}
+		}
+
+		if _, err := l.pathHandler.Add(envVar, element, -1); err != nil {
 			return klib.ForwardError("b3bf3b89-656b-4882-bdb7-b773d708ea64", err)
 		}
 	}
 
 	return nil
 }
+
+// expandPath expands a leading ~ or ~user in value to the respective home directory.
+// If value is a glob pattern, the matching directories are returned in lexical order.
+// If skipMissing is true, values that do not exist in the filesystem are dropped.
+func expandPath(value string, skipMissing bool) ([]string, error) {
+	value, err := expandTilde(strings.TrimSpace(value))
+	if err != nil {
+		return nil, klib.ForwardError("6f4b30fc-70de-4fc0-82ee-ab0dfaa0ff57", err)
+	}
+
+	if !strings.ContainsAny(value, "*?[") {
+		if skipMissing {
+			if _, err := os.Stat(value); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil, nil
+				}
+
+				return nil, &klib.Error{
+					ID:     "81a17594-cf91-4c55-8423-d5e1963f7ed8",
+					Status: http.StatusInternalServerError,
+					Code:   klib.CodeFilesystemError,
+					Title:  "Failed to stat path",
+					Cause:  err.Error(),
+					Meta: map[string]any{
+						"value": value,
+					},
+				}
+			}
+		}
+
+		return []string{value}, nil
+	}
+
+	matches, err := filepath.Glob(value)
+	if err != nil {
+		return nil, &klib.Error{
+			ID:     "e84fbf75-09d0-4aa1-b324-50cc1e3767eb",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeParseError,
+			Detail: fmt.Sprintf("Invalid glob pattern: %s.", value),
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"value": value,
+			},
+		}
+	}
+
+	sort.Strings(matches)
+	values := make([]string, 0, len(matches))
+
+	for i := range matches {
+		// Only directories are meaningful in path lists.
+		if info, err := os.Stat(matches[i]); err != nil || !info.IsDir() {
+			continue
+		}
+
+		values = append(values, matches[i])
+	}
+
+	return values, nil
+}
+
+// expandTilde replaces a leading ~ or ~user in value with the respective home directory.
+func expandTilde(value string) (string, error) {
+	if !strings.HasPrefix(value, "~") {
+		return value, nil
+	}
+
+	name, rest := value[1:], ""
+
+	if i := strings.IndexAny(name, "/"+string(filepath.Separator)); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+
+	var home string
+
+	if name == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", &klib.Error{
+				ID:     "ee53fe17-9841-4a3a-8dd1-663d30fdfc1f",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeFilesystemError,
+				Title:  "Failed to get user home dir",
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"value": value,
+				},
+			}
+		}
+
+		home = dir
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", &klib.Error{
+				ID:     "df0f955c-c2c9-419b-8da0-c8186791d5d4",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeNotFound,
+				Detail: fmt.Sprintf("Failed to lookup home dir of user %s.", name),
+				Cause:  err.Error(),
+				Meta: map[string]any{
+					"value": value,
+				},
+			}
+		}
+
+		home = u.HomeDir
+	}
+
+	return home + rest, nil
+}
@@ -2,7 +2,9 @@ package env
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -13,6 +15,23 @@ import (
 )
 
 func Test_defaultPathHandler_Add(t *testing.T) {
+	// Resolve the temp dir itself, as it might be behind a symlink.
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realDir := filepath.Join(dir, "real")
+	linkDir := filepath.Join(dir, "link")
+
+	if err := os.Mkdir(realDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(realDir, linkDir); err != nil {
+		t.Fatal(err)
+	}
+
 	testCases := []*struct {
 		name         string
 		pathHandler  *defaultPathHandler
@@ -142,17 +161,63 @@ func Test_defaultPathHandler_Add(t *testing.T) {
 				must.FilepathAbs("bar"),
 			},
 		},
+		{
+			name: "ignore-symlinked-path",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					realDir,
+				},
+				pathListElementExists: map[string]bool{
+					realDir: true,
+				},
+			},
+			value: linkDir,
+			pathHandler: &defaultPathHandler{
+				caseSensitiveFilesystem: true,
+				resolveSymlinks:         true,
+			},
+			wantPathList: []string{
+				realDir,
+			},
+		},
+		{
+			name: "keep-symlinked-path-spelling",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					must.FilepathAbs("a"),
+				},
+				pathListElementExists: map[string]bool{
+					must.FilepathAbs("a"): true,
+				},
+			},
+			value:    linkDir,
+			position: -1,
+			pathHandler: &defaultPathHandler{
+				caseSensitiveFilesystem: true,
+				resolveSymlinks:         true,
+			},
+			wantPathList: []string{
+				must.FilepathAbs("a"),
+				linkDir,
+			},
+		},
 	}
 
 	for i := range testCases {
 		tc := testCases[i]
 
 		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
-			err := tc.pathHandler.Add(tc.envVar, tc.value, tc.position)
+			length := len(tc.envVar.pathListElements)
+
+			added, err := tc.pathHandler.Add(tc.envVar, tc.value, tc.position)
 			if klib.CheckTestError(st, err, tc.err) {
 				return
 			}
 
+			assert.Equal(st, length+1 == len(tc.envVar.pathListElements), added, "Added mismatch")
+
 			havePathList := tc.envVar.pathListElements
 			wantPathList := tc.wantPathList
 
@@ -168,11 +233,159 @@ func Test_defaultPathHandler_Add(t *testing.T) {
 	}
 }
 
+func Test_defaultPathHandler_Index(t *testing.T) {
+	testCases := []*struct {
+		name        string
+		pathHandler *defaultPathHandler
+		envVar      *environVar
+		value       string
+		err         *klib.Error
+		wantIndex   int
+	}{
+		{
+			name: "empty-path-list",
+			envVar: &environVar{
+				key: "foo",
+			},
+			value:       must.FilepathAbs("bar"),
+			pathHandler: &defaultPathHandler{},
+			wantIndex:   -1,
+		},
+		{
+			name: "existing-path-case-insensitive",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					must.FilepathAbs("a"),
+					must.FilepathAbs("b"),
+				},
+				pathListElementExists: map[string]bool{
+					strings.ToUpper(must.FilepathAbs("a")): true,
+					strings.ToUpper(must.FilepathAbs("b")): true,
+				},
+			},
+			value:       strings.ToUpper(must.FilepathAbs("b")),
+			pathHandler: &defaultPathHandler{},
+			wantIndex:   1,
+		},
+		{
+			name: "missing-path-case-sensitive",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					must.FilepathAbs("a"),
+					must.FilepathAbs("b"),
+				},
+				pathListElementExists: map[string]bool{
+					must.FilepathAbs("a"): true,
+					must.FilepathAbs("b"): true,
+				},
+			},
+			value: strings.ToUpper(must.FilepathAbs("b")),
+			pathHandler: &defaultPathHandler{
+				caseSensitiveFilesystem: true,
+			},
+			wantIndex: -1,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := tc.pathHandler.Index(tc.envVar, tc.value)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantIndex, have, "Index mismatch")
+		})
+	}
+}
+
+func Test_defaultPathHandler_Remove(t *testing.T) {
+	testCases := []*struct {
+		name          string
+		pathHandler   *defaultPathHandler
+		envVar        *environVar
+		value         string
+		err           *klib.Error
+		wantPathList  []string
+		wantElemExist map[string]bool
+	}{
+		{
+			name: "missing-path",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					must.FilepathAbs("a"),
+				},
+				pathListElementExists: map[string]bool{
+					must.FilepathAbs("a"): true,
+				},
+			},
+			value: must.FilepathAbs("bar"),
+			pathHandler: &defaultPathHandler{
+				caseSensitiveFilesystem: true,
+			},
+			wantPathList: []string{
+				must.FilepathAbs("a"),
+			},
+			wantElemExist: map[string]bool{
+				must.FilepathAbs("a"): true,
+			},
+		},
+		{
+			name: "existing-path",
+			envVar: &environVar{
+				key: "foo",
+				pathListElements: []string{
+					must.FilepathAbs("a"),
+					must.FilepathAbs("bar"),
+					must.FilepathAbs("b"),
+				},
+				pathListElementExists: map[string]bool{
+					must.FilepathAbs("a"):   true,
+					must.FilepathAbs("bar"): true,
+					must.FilepathAbs("b"):   true,
+				},
+			},
+			value: must.FilepathAbs("bar"),
+			pathHandler: &defaultPathHandler{
+				caseSensitiveFilesystem: true,
+			},
+			wantPathList: []string{
+				must.FilepathAbs("a"),
+				must.FilepathAbs("b"),
+			},
+			wantElemExist: map[string]bool{
+				must.FilepathAbs("a"): true,
+				must.FilepathAbs("b"): true,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			err := tc.pathHandler.Remove(tc.envVar, tc.value)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantPathList, tc.envVar.pathListElements, "Path list mismatch")
+			assert.Equal(st, tc.wantElemExist, tc.envVar.pathListElementExists, "Path list element exists mismatch")
+		})
+	}
+}
+
 func Test_defaultPathLoader_Load(t *testing.T) {
 	cache := mucache.New[string, *environVar]()
 	pathA := must.FilepathAbs("a")
 	pathB := must.FilepathAbs("b")
 	pathC := must.FilepathAbs("c")
+	existingPath := t.TempDir()
 
 	testCases := []*struct {
 		name              string
@@ -236,6 +449,28 @@ func Test_defaultPathLoader_Load(t *testing.T) {
 				{"Add", cache.Get("ignore-empty-path-element"), pathC, -1, nil},
 			},
 		},
+		{
+			name: "prune-missing-path-element",
+			envVar: cache.SetGet(
+				"prune-missing-path-element",
+				&environVar{
+					currentValue: strings.Join(
+						[]string{
+							pathA,
+							existingPath,
+							pathC,
+						},
+						string(os.PathListSeparator),
+					),
+				},
+			),
+			pathLoader: &defaultPathLoader{
+				prune: true,
+			},
+			mockPathHandlerOn: [][]any{
+				{"Add", cache.Get("prune-missing-path-element"), existingPath, -1, nil},
+			},
+		},
 	}
 
 	for i := range testCases {
@@ -247,7 +482,7 @@ func Test_defaultPathLoader_Load(t *testing.T) {
 
 				for j := range tc.mockPathHandlerOn {
 					on := tc.mockPathHandlerOn[j]
-					mockPathHandler.On(on[0].(string), on[1], on[2], on[3]).Return(on[4])
+					mockPathHandler.On(on[0].(string), on[1], on[2], on[3]).Return(true, on[4])
 				}
 
 				tc.pathLoader.pathHandler = mockPathHandler
@@ -260,3 +495,90 @@ func Test_defaultPathLoader_Load(t *testing.T) {
 		})
 	}
 }
+
+func Test_expandPath(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"b", "a", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, "tools", name, "bin"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tools", "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOME", dir)
+	t.Setenv("USERPROFILE", dir)
+
+	testCases := []*struct {
+		name        string
+		value       string
+		skipMissing bool
+		err         *klib.Error
+		wantValues  []string
+	}{
+		{
+			name:       "literal",
+			value:      " foo ",
+			wantValues: []string{"foo"},
+		},
+		{
+			name:  "tilde",
+			value: "~/go/bin",
+			wantValues: []string{
+				dir + "/go/bin",
+			},
+		},
+		{
+			name:  "glob-sorted-dirs-only",
+			value: filepath.Join("~", "tools", "*"),
+			wantValues: []string{
+				filepath.Join(dir, "tools", "a"),
+				filepath.Join(dir, "tools", "b"),
+				filepath.Join(dir, "tools", "c"),
+			},
+		},
+		{
+			name:       "glob-without-matches",
+			value:      filepath.Join(dir, "missing", "*"),
+			wantValues: []string{},
+		},
+		{
+			name:        "skip-missing",
+			value:       filepath.Join(dir, "missing"),
+			skipMissing: true,
+		},
+		{
+			name:        "keep-existing",
+			value:       filepath.Join(dir, "tools", "a", "bin"),
+			skipMissing: true,
+			wantValues: []string{
+				filepath.Join(dir, "tools", "a", "bin"),
+			},
+		},
+		{
+			name:  "invalid-glob",
+			value: "[",
+			err: &klib.Error{
+				ID:     "e84fbf75-09d0-4aa1-b324-50cc1e3767eb",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeParseError,
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			have, err := expandPath(tc.value, tc.skipMissing)
+			if klib.CheckTestError(st, err, tc.err) {
+				return
+			}
+
+			assert.Equal(st, tc.wantValues, have, "Values mismatch")
+		})
+	}
+}
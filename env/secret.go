@@ -0,0 +1,440 @@
+package env
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+// DefaultSecretTimeout is how long a secret provider may run
+// when no timeout is configured.
+const DefaultSecretTimeout = 10 * time.Second
+
+// DefaultSecretCacheTTL is how long the file cache keeps resolved secrets
+// across loads when no TTL is configured.
+const DefaultSecretCacheTTL = 5 * time.Minute
+
+// Caches of resolved secrets. The memory cache lives for a single load,
+// so each load resolves its secrets again and the TTL has no effect;
+// only the file cache keeps them for the TTL across loads.
+const (
+	SecretCacheMemory = "memory"
+	SecretCacheFile   = "file"
+)
+
+// SecretResolver resolves the secret of a key with a provider,
+// running it with the environ being loaded.
+type SecretResolver interface {
+	Resolve(provider, key string, environ []string) (string, error)
+}
+
+type secretProvider struct {
+	name    string
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+type secretCacheEntry struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+type defaultSecretResolver struct {
+	providers map[string]*secretProvider
+
+	// The provider of keys without one, if there is a single provider.
+	defaultProvider string
+
+	ttl   time.Duration
+	cache map[string]*secretCacheEntry
+
+	// Where the cache is persisted, encrypted with the key at keyPath,
+	// if the cache is a file.
+	cachePath   string
+	keyPath     string
+	cacheLoaded bool
+}
+
+func newSecretResolver(secrets *conf.Secrets) (*defaultSecretResolver, error) {
+	r := &defaultSecretResolver{
+		providers: make(map[string]*secretProvider),
+		ttl:       DefaultSecretCacheTTL,
+		cache:     make(map[string]*secretCacheEntry),
+	}
+
+	if secrets == nil {
+		return r, nil
+	}
+
+	for i, provider := range secrets.Providers {
+		name := strings.TrimSpace(provider.Name)
+
+		if name == "" {
+			return nil, &klib.Error{
+				ID:     "0497ab5a-6001-46f0-965e-4f99b18c081c",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   fmt.Sprintf(".secrets.providers[%d].name", i),
+				Detail: "Secret provider name cannot be empty.",
+			}
+		}
+
+		if _, ok := r.providers[name]; ok {
+			return nil, &klib.Error{
+				ID:     "f979670c-0471-4203-9a61-9377e13d16f5",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   fmt.Sprintf(".secrets.providers[%d].name", i),
+				Detail: fmt.Sprintf("Duplicate secret provider %q.", name),
+			}
+		}
+
+		if strings.TrimSpace(provider.Command) == "" {
+			return nil, &klib.Error{
+				ID:     "405a3a1f-d7e4-4b64-b1d9-7d8504feef1b",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   fmt.Sprintf(".secrets.providers[%d].command", i),
+				Detail: fmt.Sprintf("Secret provider %q command cannot be empty.", name),
+			}
+		}
+
+		timeout := DefaultSecretTimeout
+
+		if provider.Timeout != "" {
+			d, err := time.ParseDuration(provider.Timeout)
+			if err != nil {
+				return nil, &klib.Error{
+					ID:     "1c7546c1-6287-4ef6-aeee-0cce8abaa4f6",
+					Status: http.StatusBadRequest,
+					Code:   klib.CodeInvalidValue,
+					Path:   fmt.Sprintf(".secrets.providers[%d].timeout", i),
+					Detail: fmt.Sprintf("Invalid secret provider timeout %q.", provider.Timeout),
+					Cause:  err.Error(),
+				}
+			}
+
+			timeout = d
+		}
+
+		r.providers[name] = &secretProvider{
+			name:    name,
+			command: provider.Command,
+			args:    provider.Args,
+			timeout: timeout,
+		}
+	}
+
+	if len(secrets.Providers) == 1 {
+		r.defaultProvider = strings.TrimSpace(secrets.Providers[0].Name)
+	}
+
+	if secrets.CacheTTL != "" {
+		d, err := time.ParseDuration(secrets.CacheTTL)
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "d3048726-471f-4bf9-8b8a-7c0260801b27",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.cacheTTL",
+				Detail: fmt.Sprintf("Invalid secret cache TTL %q.", secrets.CacheTTL),
+				Cause:  err.Error(),
+			}
+		}
+
+		r.ttl = d
+	}
+
+	switch secrets.Cache {
+	case "", SecretCacheMemory:
+	case SecretCacheFile:
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, &klib.Error{
+				ID:     "07cbb05b-df11-4eab-9bad-2cc9daf4927d",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeFilesystemError,
+				Path:   ".secrets.cache",
+				Title:  "Failed to get user cache dir",
+				Cause:  err.Error(),
+			}
+		}
+
+		// The key must not outlive the user session, nor sit next to the cache
+		// it encrypts, which would protect nothing.
+		runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+		if !filepath.IsAbs(runtimeDir) {
+			return nil, &klib.Error{
+				ID:     "3d5182cf-bc50-4a57-bfb4-747fc9786c2d",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.cache",
+				Detail: fmt.Sprintf("Secret cache %q needs $XDG_RUNTIME_DIR to keep its key, use %q instead.", SecretCacheFile, SecretCacheMemory),
+			}
+		}
+
+		r.cachePath = filepath.Join(cacheDir, "xpdt", "secrets.cache")
+		r.keyPath = filepath.Join(runtimeDir, "xpdt", "secrets.key")
+	default:
+		return nil, &klib.Error{
+			ID:     "84c2dbf4-4be4-43ac-bfb9-f367765348ed",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeInvalidValue,
+			Path:   ".secrets.cache",
+			Detail: fmt.Sprintf("Invalid secret cache %q, must be one of %s or %s.", secrets.Cache, SecretCacheMemory, SecretCacheFile),
+		}
+	}
+
+	return r, nil
+}
+
+func (r *defaultSecretResolver) Resolve(providerName, key string, environ []string) (string, error) {
+	if providerName == "" {
+		providerName = r.defaultProvider
+	}
+
+	if providerName == "" {
+		return "", &klib.Error{
+			ID:     "56f99d72-0931-43f9-933c-7e2e206740a1",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+			Detail: fmt.Sprintf("Secret %q needs a provider, since there is not a single one configured.", key),
+		}
+	}
+
+	provider, ok := r.providers[providerName]
+	if !ok {
+		return "", &klib.Error{
+			ID:     "35af7044-ae0f-4390-b6bb-a68f33739bf7",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeNotFound,
+			Detail: fmt.Sprintf("Secret provider %q is not configured.", providerName),
+		}
+	}
+
+	id := secretCacheID(providerName, key)
+
+	r.loadCache()
+
+	if entry, ok := r.cache[id]; ok && time.Now().Before(entry.Expires) {
+		log.Debug().
+			Str("_label", "secretResolved").
+			Str("provider", providerName).
+			Str("key", key).
+			Bool("cached", true).
+			Send()
+
+		return entry.Value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), provider.timeout)
+	defer cancel()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, provider.command, append(append([]string{}, provider.args...), key)...)
+	cmd.Env = environ
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", &klib.Error{
+				ID:     "9e8d24b2-a7c1-4b5b-af57-bf062344da2e",
+				Status: http.StatusGatewayTimeout,
+				Code:   klib.CodeExecutionError,
+				Detail: fmt.Sprintf("Secret provider %q timed out after %s for key %q.", providerName, provider.timeout, key),
+				Cause:  err.Error(),
+			}
+		}
+
+		return "", &klib.Error{
+			ID:     "376510af-3635-4c2c-8833-a6c3ee9c5c39",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+			Detail: fmt.Sprintf("Secret provider %q failed for key %q.", providerName, key),
+			Cause:  err.Error(),
+			Meta: map[string]any{
+				"stderr": strings.TrimSpace(stderr.String()),
+			},
+		}
+	}
+
+	value := strings.TrimRight(stdout.String(), "\r\n")
+
+	r.cache[id] = &secretCacheEntry{
+		Value:   value,
+		Expires: time.Now().Add(r.ttl),
+	}
+
+	log.Debug().
+		Str("_label", "secretResolved").
+		Str("provider", providerName).
+		Str("key", key).
+		Bool("cached", false).
+		Send()
+
+	r.saveCache()
+
+	return value, nil
+}
+
+// loadCache loads the cache file, if any, once.
+// A cache that cannot be read is ignored.
+func (r *defaultSecretResolver) loadCache() {
+	if r.cachePath == "" || r.cacheLoaded {
+		return
+	}
+
+	r.cacheLoaded = true
+
+	if err := func() error {
+		key, err := os.ReadFile(r.keyPath)
+		if err != nil {
+			return err
+		}
+
+		b, err := os.ReadFile(r.cachePath)
+		if err != nil {
+			return err
+		}
+
+		b, err = open(key, b)
+		if err != nil {
+			return err
+		}
+
+		return json.Unmarshal(b, &r.cache)
+	}(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Debug().
+			Str("_label", "secretCacheIgnored").
+			Str("filepath", r.cachePath).
+			Err(err).
+			Send()
+	}
+}
+
+// saveCache writes the unexpired secrets to the cache file, if any.
+// Failing to write the cache does not fail the load.
+func (r *defaultSecretResolver) saveCache() {
+	if r.cachePath == "" {
+		return
+	}
+
+	if err := func() error {
+		key, err := readOrCreateKey(r.keyPath)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		cache := make(map[string]*secretCacheEntry, len(r.cache))
+
+		for id, entry := range r.cache {
+			if now.Before(entry.Expires) {
+				cache[id] = entry
+			}
+		}
+
+		b, err := json.Marshal(cache)
+		if err != nil {
+			return err
+		}
+
+		b, err = seal(key, b)
+		if err != nil {
+			return err
+		}
+
+		return writePrivateFile(r.cachePath, b)
+	}(); err != nil {
+		log.Debug().
+			Str("_label", "secretCacheNotSaved").
+			Str("filepath", r.cachePath).
+			Err(err).
+			Send()
+	}
+}
+
+// secretCacheID identifies the secret of key in the cache,
+// without revealing the key.
+func secretCacheID(provider, key string) string {
+	sum := sha256.Sum256([]byte(provider + "\x00" + key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// readOrCreateKey reads the key at path, or creates a random one.
+func readOrCreateKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, keySize)
+
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	if err := writePrivateFile(path, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// writePrivateFile writes b to path, readable only by the user,
+// replacing the file at once.
+func writePrivateFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
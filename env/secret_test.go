@@ -0,0 +1,281 @@
+package env
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.katupy.io/klib"
+
+	"go.katupy.io/xpdt/conf"
+)
+
+func Test_newSecretResolver(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "")
+
+	testCases := []*struct {
+		name    string
+		secrets *conf.Secrets
+		err     *klib.Error
+	}{
+		{
+			name: "empty-name",
+			secrets: &conf.Secrets{
+				Providers: []*conf.SecretProvider{{Command: "pass"}},
+			},
+			err: &klib.Error{
+				ID:     "0497ab5a-6001-46f0-965e-4f99b18c081c",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".secrets.providers[0].name",
+			},
+		},
+		{
+			name: "duplicate-name",
+			secrets: &conf.Secrets{
+				Providers: []*conf.SecretProvider{
+					{Name: "pass", Command: "pass"},
+					{Name: "pass", Command: "gopass"},
+				},
+			},
+			err: &klib.Error{
+				ID:     "f979670c-0471-4203-9a61-9377e13d16f5",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.providers[1].name",
+			},
+		},
+		{
+			name: "empty-command",
+			secrets: &conf.Secrets{
+				Providers: []*conf.SecretProvider{{Name: "pass"}},
+			},
+			err: &klib.Error{
+				ID:     "405a3a1f-d7e4-4b64-b1d9-7d8504feef1b",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeMissingValue,
+				Path:   ".secrets.providers[0].command",
+			},
+		},
+		{
+			name: "invalid-timeout",
+			secrets: &conf.Secrets{
+				Providers: []*conf.SecretProvider{{Name: "pass", Command: "pass", Timeout: "soon"}},
+			},
+			err: &klib.Error{
+				ID:     "1c7546c1-6287-4ef6-aeee-0cce8abaa4f6",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.providers[0].timeout",
+			},
+		},
+		{
+			name: "invalid-cache-ttl",
+			secrets: &conf.Secrets{
+				CacheTTL: "long",
+			},
+			err: &klib.Error{
+				ID:     "d3048726-471f-4bf9-8b8a-7c0260801b27",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.cacheTTL",
+			},
+		},
+		{
+			name: "invalid-cache",
+			secrets: &conf.Secrets{
+				Cache: "disk",
+			},
+			err: &klib.Error{
+				ID:     "84c2dbf4-4be4-43ac-bfb9-f367765348ed",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.cache",
+			},
+		},
+		{
+			name: "file-cache-without-runtime-dir",
+			secrets: &conf.Secrets{
+				Cache: SecretCacheFile,
+			},
+			err: &klib.Error{
+				ID:     "3d5182cf-bc50-4a57-bfb4-747fc9786c2d",
+				Status: http.StatusBadRequest,
+				Code:   klib.CodeInvalidValue,
+				Path:   ".secrets.cache",
+			},
+		},
+		{
+			name: "valid",
+			secrets: &conf.Secrets{
+				Providers: []*conf.SecretProvider{
+					{Name: "pass", Command: "pass", Args: []string{"show"}},
+					{Name: "op", Command: "op", Args: []string{"read"}, Timeout: "30s"},
+				},
+				Cache:    SecretCacheMemory,
+				CacheTTL: "1m",
+			},
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(fmt.Sprintf("%d:%s", i, tc.name), func(st *testing.T) {
+			_, err := newSecretResolver(tc.secrets)
+			klib.CheckTestError(st, err, tc.err)
+		})
+	}
+}
+
+func Test_defaultSecretResolver_Resolve(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test provider is a shell script")
+	}
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+
+	// The provider prints the secret of its last argument,
+	// and records each call.
+	provider := filepath.Join(dir, "provider")
+	script := `#!/bin/sh
+echo "$1" >> "` + calls + `"
+case "$1" in
+fail) echo "no such secret" >&2; exit 1 ;;
+*) echo "secret-of-$1-$PREFIX" ;;
+esac
+`
+
+	if err := os.WriteFile(provider, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	callCount := func() int {
+		b, _ := os.ReadFile(calls)
+
+		return strings.Count(string(b), "\n")
+	}
+
+	newResolver := func(st *testing.T, cache, ttl string, providers ...string) *defaultSecretResolver {
+		secrets := &conf.Secrets{Cache: cache, CacheTTL: ttl}
+
+		for _, name := range providers {
+			secrets.Providers = append(secrets.Providers, &conf.SecretProvider{
+				Name:    name,
+				Command: provider,
+			})
+		}
+
+		r, err := newSecretResolver(secrets)
+		if err != nil {
+			st.Fatal(err)
+		}
+
+		return r
+	}
+
+	t.Run("resolve-and-cache", func(st *testing.T) {
+		os.Remove(calls)
+		r := newResolver(st, "", "", "test")
+
+		for i := 0; i < 2; i++ {
+			have, err := r.Resolve("", "foo", []string{"PREFIX=bar"})
+			if assert.NoError(st, err) {
+				assert.Equal(st, "secret-of-foo-bar", have, "Secret mismatch")
+			}
+		}
+
+		assert.Equal(st, 1, callCount(), "Provider calls mismatch")
+	})
+
+	t.Run("missing-provider", func(st *testing.T) {
+		r := newResolver(st, "", "", "a", "b")
+
+		_, err := r.Resolve("", "foo", nil)
+		klib.CheckTestError(st, err, &klib.Error{
+			ID:     "56f99d72-0931-43f9-933c-7e2e206740a1",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeMissingValue,
+		})
+	})
+
+	t.Run("unknown-provider", func(st *testing.T) {
+		r := newResolver(st, "", "", "test")
+
+		_, err := r.Resolve("other", "foo", nil)
+		klib.CheckTestError(st, err, &klib.Error{
+			ID:     "35af7044-ae0f-4390-b6bb-a68f33739bf7",
+			Status: http.StatusBadRequest,
+			Code:   klib.CodeNotFound,
+		})
+	})
+
+	t.Run("provider-failure", func(st *testing.T) {
+		r := newResolver(st, "", "", "test")
+
+		_, err := r.Resolve("test", "fail", nil)
+		klib.CheckTestError(st, err, &klib.Error{
+			ID:     "376510af-3635-4c2c-8833-a6c3ee9c5c39",
+			Status: http.StatusInternalServerError,
+			Code:   klib.CodeExecutionError,
+		})
+	})
+
+	t.Run("file-cache", func(st *testing.T) {
+		st.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+		st.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "runtime"))
+		os.Remove(calls)
+
+		for i := 0; i < 2; i++ {
+			r := newResolver(st, SecretCacheFile, "", "test")
+
+			have, err := r.Resolve("test", "foo", nil)
+			if assert.NoError(st, err) {
+				assert.Equal(st, "secret-of-foo-", have, "Secret mismatch")
+			}
+		}
+
+		assert.Equal(st, 1, callCount(), "Provider calls mismatch")
+
+		b, err := os.ReadFile(filepath.Join(dir, "cache", "xpdt", "secrets.cache"))
+		if assert.NoError(st, err) {
+			assert.NotContains(st, string(b), "secret-of-foo", "Cache is not encrypted")
+		}
+
+		info, err := os.Stat(filepath.Join(dir, "runtime", "xpdt", "secrets.key"))
+		if assert.NoError(st, err) {
+			assert.Equal(st, os.FileMode(0o600), info.Mode().Perm(), "Key mode mismatch")
+		}
+	})
+	t.Run("file-cache-ttl", func(st *testing.T) {
+		st.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "ttl-cache"))
+		st.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "ttl-runtime"))
+		os.Remove(calls)
+
+		resolve := func(ttl string) {
+			r := newResolver(st, SecretCacheFile, ttl, "test")
+
+			have, err := r.Resolve("test", "foo", nil)
+			if assert.NoError(st, err) {
+				assert.Equal(st, "secret-of-foo-", have, "Secret mismatch")
+			}
+		}
+
+		// The value is reused by later loads within its TTL.
+		resolve("1h")
+		resolve("1h")
+		assert.Equal(st, 1, callCount(), "Provider calls mismatch within TTL")
+
+		// A value cached for no time is resolved again by the next load.
+		os.Remove(filepath.Join(dir, "ttl-cache", "xpdt", "secrets.cache"))
+		resolve("1ns")
+		resolve("1ns")
+		assert.Equal(st, 3, callCount(), "Provider calls mismatch after TTL")
+	})
+}
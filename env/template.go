@@ -2,20 +2,103 @@ package env
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
 	"text/template"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"go.katupy.io/klib"
 )
 
+// Default limits of template execution.
+const (
+	DefaultTemplateTimeout   = 2 * time.Second
+	DefaultTemplateMaxOutput = 1 << 20
+)
+
+// Sandbox policies, which tell the files whose templates are restricted.
+const (
+	SandboxUntrusted = "untrusted"
+	SandboxAll       = "all"
+	SandboxOff       = "off"
+)
+
+// TemplateHandler renders the templates of the file being loaded.
+type TemplateHandler interface {
+	klib.StringHandler
+
+	// UseFile makes the handler render templates with the data of a file,
+	// restricted and confined to sandboxDir if the file is not trusted.
+	UseFile(data map[string]any, restricted bool, sandboxDir string)
+}
+
 type templateHandler struct {
 	buf     *bytes.Buffer
 	data    map[string]any
 	funcMap template.FuncMap
+
+	// Functions used instead of funcMap for the untrusted file being loaded,
+	// and for each sandbox dir.
+	restrictedFuncMap  template.FuncMap
+	restrictedFuncMaps map[string]template.FuncMap
+	restricted         bool
+
+	// Execution limits, if not zero.
+	timeout   time.Duration
+	maxOutput int
+}
+
+func (h *templateHandler) UseFile(data map[string]any, restricted bool, sandboxDir string) {
+	if data != nil {
+		h.data = data
+	}
+
+	h.restricted = restricted
+
+	if !restricted {
+		return
+	}
+
+	if h.restrictedFuncMaps == nil {
+		h.restrictedFuncMaps = make(map[string]template.FuncMap)
+	}
+
+	funcMap, ok := h.restrictedFuncMaps[sandboxDir]
+	if !ok {
+		funcMap = restrictFuncs(h.funcMap, sandboxDir)
+		h.restrictedFuncMaps[sandboxDir] = funcMap
+	}
+
+	h.restrictedFuncMap = funcMap
 }
 
 func (h *templateHandler) Handle(input string) (string, error) {
-	t, err := template.New("").Funcs(h.funcMap).Parse(input)
+	funcMap := h.funcMap
+
+	if h.restricted {
+		funcMap = h.restrictedFuncMap
+	}
+
+	if h.buf == nil {
+		h.buf = new(bytes.Buffer)
+	} else {
+		h.buf.Reset()
+	}
+
+	w := &limitedWriter{
+		buf:       h.buf,
+		maxOutput: h.maxOutput,
+		stopped:   make(chan struct{}),
+	}
+
+	if h.timeout > 0 {
+		funcMap = stoppableFuncs(funcMap, w.stopped)
+	}
+
+	t, err := template.New("").Funcs(funcMap).Parse(input)
 	if err != nil {
 		return "", &klib.Error{
 			ID:     "f99a56d8-bbd5-4c53-a9c7-b5cf3ea5c0e9",
@@ -26,13 +109,55 @@ func (h *templateHandler) Handle(input string) (string, error) {
 		}
 	}
 
-	if h.buf == nil {
-		h.buf = new(bytes.Buffer)
+	data := h.data
+
+	execute := func() error {
+		return t.Execute(w, data)
+	}
+
+	if h.timeout > 0 {
+		done := make(chan error, 1)
+
+		go func() {
+			done <- execute()
+		}()
+
+		timer := time.NewTimer(h.timeout)
+		defer timer.Stop()
+
+		select {
+		case err = <-done:
+		case <-timer.C:
+			// Stop the execution, which fails at its next
+			// function call or write, and wait for it to end.
+			w.stop()
+
+			select {
+			case <-done:
+			case <-time.After(h.timeout):
+				// It is stuck in a single function call,
+				// so leave its buffer behind.
+				h.buf = nil
+
+				log.Debug().
+					Str("_label", "templateNotStopped").
+					Dur("timeout", h.timeout).
+					Send()
+			}
+
+			return "", &klib.Error{
+				ID:     "5d4113b1-1709-4ca7-ac3c-eb691888b96d",
+				Status: http.StatusGatewayTimeout,
+				Code:   klib.CodeExecutionError,
+				Title:  "Template execution timed out",
+				Detail: fmt.Sprintf("Template did not finish within %s.", h.timeout),
+			}
+		}
 	} else {
-		h.buf.Reset()
+		err = execute()
 	}
 
-	if err := t.Execute(h.buf, h.data); err != nil {
+	if err != nil {
 		return "", &klib.Error{
 			ID:     "6c9d0b27-3026-423e-93a5-10697a252fd8",
 			Status: http.StatusInternalServerError,
@@ -44,3 +169,84 @@ func (h *templateHandler) Handle(input string) (string, error) {
 
 	return h.buf.String(), nil
 }
+
+// limitedWriter fails writes beyond maxOutput bytes, if not zero,
+// or after it is stopped, which ends the template execution.
+type limitedWriter struct {
+	buf       *bytes.Buffer
+	maxOutput int
+
+	stopped chan struct{}
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.stopped:
+		return 0, errTemplateStopped
+	default:
+	}
+
+	if w.maxOutput > 0 && w.buf.Len()+len(p) > w.maxOutput {
+		return 0, fmt.Errorf("template output exceeds %d bytes", w.maxOutput)
+	}
+
+	return w.buf.Write(p)
+}
+
+func (w *limitedWriter) stop() {
+	close(w.stopped)
+}
+
+var errTemplateStopped = errors.New("template execution stopped")
+
+// stoppableFuncs returns a copy of funcMap whose functions fail
+// once stopped is closed, which ends the template execution.
+func stoppableFuncs(funcMap template.FuncMap, stopped <-chan struct{}) template.FuncMap {
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	stoppable := make(template.FuncMap, len(funcMap))
+
+	for name, fn := range funcMap {
+		v := reflect.ValueOf(fn)
+		t := v.Type()
+
+		// Functions without a result are invalid, and fail when parsed.
+		if t.Kind() != reflect.Func || t.NumOut() == 0 {
+			stoppable[name] = fn
+			continue
+		}
+
+		in := make([]reflect.Type, t.NumIn())
+
+		for i := range in {
+			in[i] = t.In(i)
+		}
+
+		out := []reflect.Type{t.Out(0), errType}
+
+		stoppable[name] = reflect.MakeFunc(reflect.FuncOf(in, out, t.IsVariadic()), func(args []reflect.Value) []reflect.Value {
+			select {
+			case <-stopped:
+				err := errTemplateStopped
+
+				return []reflect.Value{reflect.Zero(out[0]), reflect.ValueOf(&err).Elem()}
+			default:
+			}
+
+			var results []reflect.Value
+
+			if t.IsVariadic() {
+				results = v.CallSlice(args)
+			} else {
+				results = v.Call(args)
+			}
+
+			if len(results) == 1 {
+				results = append(results, reflect.Zero(errType))
+			}
+
+			return results
+		}).Interface()
+	}
+
+	return stoppable
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"runtime"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.katupy.io/klib"
@@ -55,6 +58,61 @@ func Test_templateHandler_Handle(t *testing.T) {
 			input:  `{{ ._GOOS }}_{{ .goarch }}`,
 			output: fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH),
 		},
+		{
+			name: "restricted",
+			templateHandler: &templateHandler{
+				funcMap: template.FuncMap{
+					"name": func() string { return "unrestricted" },
+				},
+				restrictedFuncMap: template.FuncMap{
+					"name": func() string { return "restricted" },
+				},
+				restricted: true,
+			},
+			input:  `{{ name }}`,
+			output: "restricted",
+		},
+		{
+			name: "timeout",
+			templateHandler: &templateHandler{
+				funcMap: template.FuncMap{
+					"sleep": func() string {
+						time.Sleep(time.Second)
+						return ""
+					},
+				},
+				timeout: 10 * time.Millisecond,
+			},
+			input: `{{ sleep }}`,
+			err: &klib.Error{
+				ID:     "5d4113b1-1709-4ca7-ac3c-eb691888b96d",
+				Status: http.StatusGatewayTimeout,
+				Code:   klib.CodeExecutionError,
+			},
+		},
+		{
+			name: "max-output",
+			templateHandler: &templateHandler{
+				funcMap:   klib.BaseFuncMap(),
+				maxOutput: 10,
+			},
+			input: `{{ repeat 11 "a" }}`,
+			err: &klib.Error{
+				ID:     "6c9d0b27-3026-423e-93a5-10697a252fd8",
+				Status: http.StatusInternalServerError,
+				Code:   klib.CodeExecutionError,
+			},
+		},
+		{
+			name: "within-limits",
+			templateHandler: &templateHandler{
+				funcMap:   klib.BaseFuncMap(),
+				timeout:   time.Second,
+				maxOutput: 10,
+			},
+			input:  `{{ repeat 10 "a" }}`,
+			output: "aaaaaaaaaa",
+		},
 	}
 
 	for i := range testCases {
@@ -72,3 +130,38 @@ func Test_templateHandler_Handle(t *testing.T) {
 		})
 	}
 }
+
+func Test_stoppableFuncs(t *testing.T) {
+	var calls atomic.Int32
+
+	h := &templateHandler{
+		funcMap: template.FuncMap{
+			"until": func(n int) []int { return make([]int, n) },
+			"tick": func() string {
+				calls.Add(1)
+				time.Sleep(time.Millisecond)
+				return ""
+			},
+		},
+		timeout: 20 * time.Millisecond,
+	}
+
+	_, err := h.Handle(`{{ range until 100000 }}{{ tick }}{{ end }}`)
+	klib.CheckTestError(t, err, &klib.Error{
+		ID:     "5d4113b1-1709-4ca7-ac3c-eb691888b96d",
+		Status: http.StatusGatewayTimeout,
+		Code:   klib.CodeExecutionError,
+	})
+
+	// The execution ended with the timeout, rather than running in the background.
+	stopped := calls.Load()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Equal(t, stopped, calls.Load(), "Template execution was not stopped")
+	assert.NotNil(t, h.buf, "Buffer of stopped execution was left behind")
+
+	have, err := h.Handle(`{{ tick }}done`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "done", have, "Template output mismatch")
+	}
+}